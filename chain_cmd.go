@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+func runChainBlock(args []string) error {
+	flags := flag.NewFlagSet("chain block", flag.ExitOnError)
+	nodeAddr := flags.String("node", ":3000", "address of the node to query")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: blocker chain block [-node addr] <height|hash>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a block height or hash")
+	}
+
+	q := &proto.BlockQuery{}
+	if height, err := strconv.Atoi(flags.Arg(0)); err == nil {
+		q.Height = int32(height)
+	} else {
+		hash, err := hex.DecodeString(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("%q is neither a height nor a hash", flags.Arg(0))
+		}
+		q.Hash = hash
+	}
+
+	c, err := dialNode(*nodeAddr)
+	if err != nil {
+		return err
+	}
+	b, err := c.GetBlock(context.Background(), q)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("hash:      %s\n", hex.EncodeToString(types.HashBlock(b)))
+	fmt.Printf("height:    %d\n", b.Header.Height)
+	fmt.Printf("prev hash: %s\n", hex.EncodeToString(b.Header.PrevHash))
+	fmt.Printf("root hash: %s\n", hex.EncodeToString(b.Header.RootHash))
+	fmt.Printf("time:      %s\n", time.Unix(0, b.Header.Timestamp).UTC().Format(time.RFC3339Nano))
+	fmt.Printf("signer:    %s\n", hex.EncodeToString(b.PublicKey))
+	fmt.Printf("txx:       %d\n", len(b.Transactions))
+	for _, tx := range b.Transactions {
+		fmt.Printf("  %s\n", hex.EncodeToString(types.HashTransaction(tx)))
+	}
+	return nil
+}
+
+func runTxGet(args []string) error {
+	flags := flag.NewFlagSet("tx get", flag.ExitOnError)
+	nodeAddr := flags.String("node", ":3000", "address of the node to query")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: blocker tx get [-node addr] <hash>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a transaction hash")
+	}
+	hash, err := hex.DecodeString(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	c, err := dialNode(*nodeAddr)
+	if err != nil {
+		return err
+	}
+	tx, err := c.GetTransaction(context.Background(), &proto.TxQuery{Hash: hash})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("hash:    %s\n", hex.EncodeToString(types.HashTransaction(tx)))
+	fmt.Printf("version: %d\n", tx.Version)
+	fmt.Printf("inputs:  %d\n", len(tx.Inputs))
+	for _, input := range tx.Inputs {
+		fmt.Printf("  %s:%d\n", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+	}
+	fmt.Printf("outputs: %d\n", len(tx.Outputs))
+	for i, output := range tx.Outputs {
+		fmt.Printf("  %d  %s  %d\n", i, hex.EncodeToString(output.Address), output.Amount)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// BFT is a Tendermint style consensus on top of the PoA proposer schedule.
+// A proposed block only becomes final once more than two thirds of the
+// validators prevoted and then precommitted it in the same round. Those
+// precommits make up the commit certificate of the block. Unlike PoA and
+// PoW a final block is never reverted, whatever branch shows up later.
+type BFT struct {
+	*PoA
+}
+
+var _ Engine = (*BFT)(nil)
+
+func NewBFT(validators []*crypto.PublicKey, blockTime time.Duration) (*BFT, error) {
+	poa, err := NewPoA(validators, blockTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BFT{PoA: poa}, nil
+}
+
+// Quorum is the number of votes needed to move on, more than two thirds of
+// the validators.
+func (b *BFT) Quorum() int {
+	return len(b.validators)*2/3 + 1
+}
+
+// ForkChoice follows the longest chain like PoA. Between two proposals for
+// the same height the one of the later round wins, that is the one the
+// validators move on to when the earlier one doesn't get finalized.
+func (b *BFT) ForkChoice(current, candidate Branch) bool {
+	if candidate.Header.Height == current.Header.Height {
+		return candidate.Header.Timestamp > current.Header.Timestamp
+	}
+	return longestChain(current, candidate)
+}
+
+// VerifyVote checks that v is signed by a validator, the caller checks it
+// belongs to the chain.
+func (b *BFT) VerifyVote(v *proto.Vote) error {
+	if b.index(v.PublicKey) < 0 {
+		return fmt.Errorf("vote from unknown validator %x", v.PublicKey)
+	}
+	if !types.VerifyVote(v) {
+		return fmt.Errorf("invalid vote signature")
+	}
+	if v.Height <= 0 || v.Round < 0 {
+		return fmt.Errorf("invalid vote height (%d) round (%d)", v.Height, v.Round)
+	}
+	return nil
+}
+
+// VerifyCommit checks that cert holds the precommits of a quorum of
+// validators for the block with the given header.
+func (b *BFT) VerifyCommit(header *proto.Header, cert *proto.CommitCertificate) error {
+	hash := types.HashHeader(header)
+	if cert.Height != header.Height || !bytes.Equal(cert.BlockHash, hash) {
+		return fmt.Errorf("commit certificate for block %x at height %d, expected %x at height %d", cert.BlockHash, cert.Height, hash, header.Height)
+	}
+
+	set := NewVoteSet(b, proto.VoteType_PRECOMMIT, int(cert.Height), int(cert.Round))
+	for _, v := range cert.Precommits {
+		if _, err := set.Add(v); err != nil {
+			return err
+		}
+	}
+	if count := set.Count(hash); count < b.Quorum() {
+		return fmt.Errorf("commit certificate has %d precommits, %d required", count, b.Quorum())
+	}
+	return nil
+}
+
+// VoteSet collects the votes of one type cast at a height and round. Every
+// validator gets a single vote, voting for two blocks is an error.
+type VoteSet struct {
+	engine   *BFT
+	voteType proto.VoteType
+	height   int
+	round    int
+	// votes is keyed by validator public key, counts by block hash.
+	votes  map[string]*proto.Vote
+	counts map[string]int
+}
+
+func NewVoteSet(engine *BFT, voteType proto.VoteType, height, round int) *VoteSet {
+	return &VoteSet{
+		engine:   engine,
+		voteType: voteType,
+		height:   height,
+		round:    round,
+		votes:    make(map[string]*proto.Vote),
+		counts:   make(map[string]int),
+	}
+}
+
+// Add verifies v and adds it to the set, it reports false for a vote the set
+// already has.
+func (s *VoteSet) Add(v *proto.Vote) (bool, error) {
+	if v.Type != s.voteType || int(v.Height) != s.height || int(v.Round) != s.round {
+		return false, fmt.Errorf("%s at height %d round %d added to the %s set of height %d round %d", v.Type, v.Height, v.Round, s.voteType, s.height, s.round)
+	}
+	if err := s.engine.VerifyVote(v); err != nil {
+		return false, err
+	}
+
+	key := hex.EncodeToString(v.PublicKey)
+	if prev, ok := s.votes[key]; ok {
+		if bytes.Equal(prev.BlockHash, v.BlockHash) {
+			return false, nil
+		}
+		return false, fmt.Errorf("validator %x cast a %s for both %x and %x at height %d round %d", v.PublicKey, v.Type, prev.BlockHash, v.BlockHash, s.height, s.round)
+	}
+	s.votes[key] = v
+	s.counts[hex.EncodeToString(v.BlockHash)]++
+
+	return true, nil
+}
+
+func (s *VoteSet) Count(hash []byte) int {
+	return s.counts[hex.EncodeToString(hash)]
+}
+
+// Majority returns the block a quorum of validators voted for, if any.
+func (s *VoteSet) Majority() ([]byte, bool) {
+	for hash, count := range s.counts {
+		if count >= s.engine.Quorum() {
+			b, _ := hex.DecodeString(hash)
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// Certificate turns a precommit set with a majority into the commit
+// certificate of the block.
+func (s *VoteSet) Certificate() (*proto.CommitCertificate, bool) {
+	hash, ok := s.Majority()
+	if !ok || s.voteType != proto.VoteType_PRECOMMIT {
+		return nil, false
+	}
+
+	cert := &proto.CommitCertificate{
+		Height:    int32(s.height),
+		Round:     int64(s.round),
+		BlockHash: hash,
+	}
+	for _, v := range s.votes {
+		if bytes.Equal(v.BlockHash, hash) {
+			cert.Precommits = append(cert.Precommits, v)
+		}
+	}
+	sort.Slice(cert.Precommits, func(i, j int) bool {
+		return bytes.Compare(cert.Precommits[i].PublicKey, cert.Precommits[j].PublicKey) < 0
+	})
+
+	return cert, true
+}
@@ -0,0 +1,100 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	"github.com/wvalencia19/blocker/util"
+)
+
+func makeBFT(t *testing.T, n int) (*BFT, []*crypto.PrivateKey) {
+	poa, keys := makePoA(t, n)
+	bft, err := NewBFT(poa.Validators(), time.Second)
+	require.Nil(t, err)
+	return bft, keys
+}
+
+func signedVote(pk *crypto.PrivateKey, voteType proto.VoteType, height, round int, hash []byte) *proto.Vote {
+	v := &proto.Vote{
+		Type:      voteType,
+		Height:    int32(height),
+		Round:     int64(round),
+		BlockHash: hash,
+	}
+	types.SignVote(pk, v)
+	return v
+}
+
+func TestBFTQuorum(t *testing.T) {
+	for n, quorum := range map[int]int{1: 1, 3: 3, 4: 3, 7: 5, 10: 7} {
+		bft, _ := makeBFT(t, n)
+		assert.Equal(t, quorum, bft.Quorum(), "%d validators", n)
+	}
+}
+
+func TestVoteSet(t *testing.T) {
+	bft, keys := makeBFT(t, 4)
+	hash, other := util.RandomHash(), util.RandomHash()
+	set := NewVoteSet(bft, proto.VoteType_PREVOTE, 1, 0)
+
+	added, err := set.Add(signedVote(keys[0], proto.VoteType_PREVOTE, 1, 0, hash))
+	require.Nil(t, err)
+	assert.True(t, added)
+	added, err = set.Add(signedVote(keys[0], proto.VoteType_PREVOTE, 1, 0, hash))
+	require.Nil(t, err)
+	assert.False(t, added)
+
+	// equivocation, votes of another round or type and outsiders are refused
+	_, err = set.Add(signedVote(keys[0], proto.VoteType_PREVOTE, 1, 0, other))
+	assert.NotNil(t, err)
+	_, err = set.Add(signedVote(keys[1], proto.VoteType_PREVOTE, 1, 1, hash))
+	assert.NotNil(t, err)
+	_, err = set.Add(signedVote(keys[1], proto.VoteType_PRECOMMIT, 1, 0, hash))
+	assert.NotNil(t, err)
+	_, err = set.Add(signedVote(crypto.GeneratePrivatekey(), proto.VoteType_PREVOTE, 1, 0, hash))
+	assert.NotNil(t, err)
+
+	_, err = set.Add(signedVote(keys[1], proto.VoteType_PREVOTE, 1, 0, other))
+	require.Nil(t, err)
+	_, err = set.Add(signedVote(keys[2], proto.VoteType_PREVOTE, 1, 0, hash))
+	require.Nil(t, err)
+	_, ok := set.Majority()
+	assert.False(t, ok)
+
+	_, err = set.Add(signedVote(keys[3], proto.VoteType_PREVOTE, 1, 0, hash))
+	require.Nil(t, err)
+	majority, ok := set.Majority()
+	assert.True(t, ok)
+	assert.Equal(t, hash, majority)
+
+	// only precommits make a certificate
+	_, ok = set.Certificate()
+	assert.False(t, ok)
+}
+
+func TestBFTVerifyCommit(t *testing.T) {
+	bft, keys := makeBFT(t, 4)
+	header := &proto.Header{Version: 1, Height: 2, Timestamp: 42}
+	hash := types.HashHeader(header)
+
+	set := NewVoteSet(bft, proto.VoteType_PRECOMMIT, 2, 1)
+	for _, pk := range keys[:3] {
+		_, err := set.Add(signedVote(pk, proto.VoteType_PRECOMMIT, 2, 1, hash))
+		require.Nil(t, err)
+	}
+	cert, ok := set.Certificate()
+	require.True(t, ok)
+	assert.Len(t, cert.Precommits, 3)
+	assert.Nil(t, bft.VerifyCommit(header, cert))
+
+	assert.NotNil(t, bft.VerifyCommit(&proto.Header{Version: 1, Height: 2}, cert))
+
+	// duplicated precommits don't count twice
+	cert.Precommits[2] = cert.Precommits[1]
+	assert.ErrorContains(t, bft.VerifyCommit(header, cert), "2 precommits")
+}
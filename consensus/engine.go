@@ -0,0 +1,65 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+)
+
+// MaxClockDrift is how far ahead of our clock a block timestamp may be.
+const MaxClockDrift = 2 * time.Second
+
+// ChainReader gives engines access to the blocks before the one they work
+// on.
+type ChainReader interface {
+	// GetHeader returns the header of a known block, main chain or not.
+	GetHeader(hash []byte) (*proto.Header, error)
+}
+
+// Branch is the tip of a branch of the block tree as seen by fork choice.
+type Branch struct {
+	Header *proto.Header
+	// Work is the total work of the branch from genesis up to Header.
+	Work *big.Int
+}
+
+// Engine holds the rules for producing and accepting blocks. The node asks
+// it to prepare and seal the blocks it produces, the chain to verify every
+// block it receives and to decide which branch is the main chain.
+type Engine interface {
+	// PrepareHeader fills in the consensus fields of header, which extends
+	// parent, for a block produced by pubKey. The timestamp it sets may be
+	// in the future when pubKey has to wait for its turn.
+	PrepareHeader(chain ChainReader, parent, header *proto.Header, pubKey *crypto.PublicKey, now time.Time) error
+	// Seal finishes a block whose header was prepared, the block passes
+	// VerifyHeader afterwards.
+	Seal(ctx context.Context, pk *crypto.PrivateKey, b *proto.Block) error
+	// VerifyHeader checks that the header of b and its seal follow the
+	// consensus rules on top of parent.
+	VerifyHeader(chain ChainReader, parent *proto.Header, b *proto.Block, now time.Time) error
+	// Work is what a block with the given header adds to its branch.
+	Work(header *proto.Header) *big.Int
+	// ForkChoice reports whether the candidate branch should replace the
+	// current one as the main chain.
+	ForkChoice(current, candidate Branch) bool
+}
+
+// longestChain prefers the higher of two branches, on ties the one we
+// already have stays.
+func longestChain(current, candidate Branch) bool {
+	return candidate.Header.Height > current.Header.Height
+}
+
+func verifyTimestamp(parent, header *proto.Header, now time.Time) error {
+	if header.Timestamp <= parent.Timestamp {
+		return fmt.Errorf("block timestamp is not after its parent")
+	}
+	if header.Timestamp > now.Add(MaxClockDrift).UnixNano() {
+		return fmt.Errorf("block timestamp %s is in the future", time.Unix(0, header.Timestamp))
+	}
+	return nil
+}
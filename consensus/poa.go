@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// PoA is a proof of authority consensus. A fixed set of validators takes
+// turns proposing blocks, one slot of blockTime each. The validator scheduled
+// for a height is validators[(height+round)%len(validators)], where round
+// counts the slots that passed since the parent block without one. When the
+// scheduled validator misses its slot the next one takes over.
+type PoA struct {
+	validators []*crypto.PublicKey
+	blockTime  time.Duration
+}
+
+var _ Engine = (*PoA)(nil)
+
+func NewPoA(validators []*crypto.PublicKey, blockTime time.Duration) (*PoA, error) {
+	if len(validators) == 0 {
+		return nil, fmt.Errorf("empty validator set")
+	}
+	if blockTime <= 0 {
+		return nil, fmt.Errorf("invalid block time (%s)", blockTime)
+	}
+
+	return &PoA{
+		validators: validators,
+		blockTime:  blockTime,
+	}, nil
+}
+
+func (p *PoA) BlockTime() time.Duration {
+	return p.blockTime
+}
+
+func (p *PoA) Validators() []*crypto.PublicKey {
+	return p.validators
+}
+
+func (p *PoA) IsValidator(pubKey *crypto.PublicKey) bool {
+	return p.index(pubKey.Bytes()) >= 0
+}
+
+func (p *PoA) index(pubKey []byte) int {
+	for i, v := range p.validators {
+		if bytes.Equal(v.Bytes(), pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Proposer returns the validator scheduled to propose the block at height
+// after round missed slots.
+func (p *PoA) Proposer(height, round int) *crypto.PublicKey {
+	return p.validators[(height+round)%len(p.validators)]
+}
+
+// Round returns the number of slots missed between the parent block and a
+// block with the given timestamp, -1 when the first slot hasn't started yet.
+func (p *PoA) Round(parent *proto.Header, timestamp int64) int {
+	elapsed := timestamp - parent.Timestamp
+	if elapsed < int64(p.blockTime) {
+		return -1
+	}
+	return int(elapsed/int64(p.blockTime)) - 1
+}
+
+// SlotStart returns when the given round after parent begins.
+func (p *PoA) SlotStart(parent *proto.Header, round int) time.Time {
+	return time.Unix(0, parent.Timestamp).Add(p.blockTime * time.Duration(round+1))
+}
+
+// NextSlot returns the first round after parent, starting at the one running
+// at now, in which pubKey is the proposer.
+func (p *PoA) NextSlot(parent *proto.Header, pubKey *crypto.PublicKey, now time.Time) (int, error) {
+	i := p.index(pubKey.Bytes())
+	if i < 0 {
+		return 0, fmt.Errorf("%s is not a validator", pubKey.Address())
+	}
+
+	round := max(p.Round(parent, now.UnixNano()), 0)
+	height := int(parent.Height) + 1
+	n := len(p.validators)
+	offset := ((i-height-round)%n + n) % n
+
+	return round + offset, nil
+}
+
+// PrepareHeader timestamps header with the start of the next slot of
+// pubKey, or now when that slot is already running.
+func (p *PoA) PrepareHeader(chain ChainReader, parent, header *proto.Header, pubKey *crypto.PublicKey, now time.Time) error {
+	round, err := p.NextSlot(parent, pubKey, now)
+	if err != nil {
+		return err
+	}
+
+	start := p.SlotStart(parent, round)
+	if now.After(start) {
+		start = now
+	}
+	header.Timestamp = start.UnixNano()
+	return nil
+}
+
+func (p *PoA) Seal(ctx context.Context, pk *crypto.PrivateKey, b *proto.Block) error {
+	types.SignBlock(pk, b)
+	return nil
+}
+
+// VerifyHeader checks that b was proposed by the validator scheduled for its
+// slot and is signed by it.
+func (p *PoA) VerifyHeader(chain ChainReader, parent *proto.Header, b *proto.Block, now time.Time) error {
+	if p.index(b.PublicKey) < 0 {
+		return fmt.Errorf("block signed by unknown validator %x", b.PublicKey)
+	}
+	if !types.VerifyBlock(b) {
+		return fmt.Errorf("invalid block signature")
+	}
+	if err := verifyTimestamp(parent, b.Header, now); err != nil {
+		return err
+	}
+
+	round := p.Round(parent, b.Header.Timestamp)
+	if round < 0 {
+		return fmt.Errorf("block proposed before its slot")
+	}
+	proposer := p.Proposer(int(b.Header.Height), round)
+	if !bytes.Equal(proposer.Bytes(), b.PublicKey) {
+		return fmt.Errorf("block at height %d round %d signed by %x, scheduled proposer is %s", b.Header.Height, round, b.PublicKey, proposer.Address())
+	}
+
+	return nil
+}
+
+// Work counts blocks, every one of them is as hard to make.
+func (p *PoA) Work(header *proto.Header) *big.Int {
+	return big.NewInt(1)
+}
+
+func (p *PoA) ForkChoice(current, candidate Branch) bool {
+	return longestChain(current, candidate)
+}
@@ -0,0 +1,134 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+func makePoA(t *testing.T, n int) (*PoA, []*crypto.PrivateKey) {
+	keys := make([]*crypto.PrivateKey, n)
+	pubKeys := make([]*crypto.PublicKey, n)
+	for i := range keys {
+		keys[i] = crypto.GeneratePrivatekey()
+		pubKeys[i] = keys[i].Public()
+	}
+	poa, err := NewPoA(pubKeys, time.Second)
+	require.Nil(t, err)
+	return poa, keys
+}
+
+func signedBlock(pk *crypto.PrivateKey, parent *proto.Header, timestamp int64) *proto.Block {
+	b := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    parent.Height + 1,
+			PrevHash:  types.HashHeader(parent),
+			Timestamp: timestamp,
+		},
+	}
+	types.SignBlock(pk, b)
+	return b
+}
+
+func TestNewPoA(t *testing.T) {
+	_, err := NewPoA(nil, time.Second)
+	assert.NotNil(t, err)
+	_, err = NewPoA([]*crypto.PublicKey{crypto.GeneratePrivatekey().Public()}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestPoAProposer(t *testing.T) {
+	poa, keys := makePoA(t, 3)
+
+	for height := 0; height < 6; height++ {
+		assert.Equal(t, keys[height%3].Public(), poa.Proposer(height, 0))
+		// a missed slot hands the height to the next validator
+		assert.Equal(t, keys[(height+1)%3].Public(), poa.Proposer(height, 1))
+	}
+	assert.True(t, poa.IsValidator(keys[0].Public()))
+	assert.False(t, poa.IsValidator(crypto.GeneratePrivatekey().Public()))
+}
+
+func TestPoARound(t *testing.T) {
+	poa, _ := makePoA(t, 3)
+	parent := &proto.Header{Timestamp: int64(10 * time.Second)}
+
+	assert.Equal(t, -1, poa.Round(parent, int64(10500*time.Millisecond)))
+	assert.Equal(t, 0, poa.Round(parent, int64(11*time.Second)))
+	assert.Equal(t, 0, poa.Round(parent, int64(11900*time.Millisecond)))
+	assert.Equal(t, 2, poa.Round(parent, int64(13*time.Second)))
+	assert.Equal(t, time.Unix(0, int64(13*time.Second)), poa.SlotStart(parent, 2))
+}
+
+func TestPoANextSlot(t *testing.T) {
+	poa, keys := makePoA(t, 3)
+	parent := &proto.Header{Height: 4, Timestamp: int64(10 * time.Second)}
+	now := time.Unix(0, int64(10*time.Second))
+
+	// height 5 belongs to validator 2, then 0, then 1
+	for i, want := range []int{1, 2, 0} {
+		round, err := poa.NextSlot(parent, keys[i].Public(), now)
+		require.Nil(t, err)
+		assert.Equal(t, want, round)
+	}
+
+	// once the first two slots passed validator 2 waits for its next turn
+	round, err := poa.NextSlot(parent, keys[2].Public(), now.Add(3*time.Second))
+	require.Nil(t, err)
+	assert.Equal(t, 3, round)
+
+	_, err = poa.NextSlot(parent, crypto.GeneratePrivatekey().Public(), now)
+	assert.NotNil(t, err)
+}
+
+func TestPoAVerifyHeader(t *testing.T) {
+	poa, keys := makePoA(t, 3)
+	parent := &proto.Header{Height: 4, Timestamp: int64(10 * time.Second)}
+	slot := int64(11 * time.Second)
+	now := time.Unix(0, int64(20*time.Second))
+
+	assert.Nil(t, poa.VerifyHeader(nil, parent, signedBlock(keys[2], parent, slot), now))
+	// not scheduled for the first slot
+	assert.NotNil(t, poa.VerifyHeader(nil, parent, signedBlock(keys[0], parent, slot), now))
+	// but takes over once validator 2 missed it
+	assert.Nil(t, poa.VerifyHeader(nil, parent, signedBlock(keys[0], parent, slot+int64(time.Second)), now))
+	// unknown signer
+	assert.NotNil(t, poa.VerifyHeader(nil, parent, signedBlock(crypto.GeneratePrivatekey(), parent, slot), now))
+	// before the first slot started
+	assert.NotNil(t, poa.VerifyHeader(nil, parent, signedBlock(keys[2], parent, slot-1), now))
+	// too far in the future
+	assert.NotNil(t, poa.VerifyHeader(nil, parent, signedBlock(keys[2], parent, slot), time.Unix(0, slot).Add(-MaxClockDrift-time.Second)))
+
+	b := signedBlock(keys[2], parent, slot)
+	b.Signature = keys[2].Sign([]byte("junk")).Bytes()
+	assert.NotNil(t, poa.VerifyHeader(nil, parent, b, now))
+}
+
+func TestPoAPrepareHeader(t *testing.T) {
+	poa, keys := makePoA(t, 3)
+	parent := &proto.Header{Height: 4, Timestamp: int64(10 * time.Second)}
+	now := time.Unix(0, int64(10*time.Second))
+
+	// validator 0 is second in line for height 5
+	header := &proto.Header{Height: 5}
+	require.Nil(t, poa.PrepareHeader(nil, parent, header, keys[0].Public(), now))
+	assert.Equal(t, int64(12*time.Second), header.Timestamp)
+
+	// inside its own slot the validator produces right away
+	now = time.Unix(0, int64(11500*time.Millisecond))
+	require.Nil(t, poa.PrepareHeader(nil, parent, header, keys[2].Public(), now))
+	assert.Equal(t, now.UnixNano(), header.Timestamp)
+
+	b := &proto.Block{Header: header}
+	require.Nil(t, poa.Seal(context.Background(), keys[2], b))
+	assert.Nil(t, poa.VerifyHeader(nil, parent, b, now))
+
+	assert.NotNil(t, poa.PrepareHeader(nil, parent, header, crypto.GeneratePrivatekey().Public(), now))
+}
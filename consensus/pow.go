@@ -0,0 +1,204 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// maxRetargetFactor bounds how much the target moves in one retarget.
+const maxRetargetFactor = 4
+
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// PoW is a proof of work consensus. A block is valid when its hash, read as
+// a big endian number, is at most the target encoded in its bits. Every
+// interval blocks the target is scaled by how long the last interval took
+// compared to blockTime per block, it never gets easier than the genesis
+// difficulty. Anyone can mine, the miner still signs the block so it can be
+// told apart from other miners.
+type PoW struct {
+	limit     *big.Int
+	blockTime time.Duration
+	interval  int
+}
+
+var _ Engine = (*PoW)(nil)
+
+// NewPoW creates a proof of work whose easiest target needs difficulty
+// leading zero bits in block hashes.
+func NewPoW(difficulty int, blockTime time.Duration, interval int) (*PoW, error) {
+	if difficulty < 0 || difficulty > 255 {
+		return nil, fmt.Errorf("invalid difficulty (%d)", difficulty)
+	}
+	if blockTime <= 0 {
+		return nil, fmt.Errorf("invalid block time (%s)", blockTime)
+	}
+	if interval < 2 {
+		return nil, fmt.Errorf("invalid retarget interval (%d)", interval)
+	}
+
+	return &PoW{
+		limit:     CompactToBig(DifficultyToBits(difficulty)),
+		blockTime: blockTime,
+		interval:  interval,
+	}, nil
+}
+
+// DifficultyToBits returns the compact target that needs difficulty leading
+// zero bits in a hash.
+func DifficultyToBits(difficulty int) uint32 {
+	target := new(big.Int).Rsh(oneLsh256, uint(difficulty))
+	return BigToCompact(target.Sub(target, big.NewInt(1)))
+}
+
+func (p *PoW) PrepareHeader(chain ChainReader, parent, header *proto.Header, pubKey *crypto.PublicKey, now time.Time) error {
+	bits, err := p.NextBits(chain, parent)
+	if err != nil {
+		return err
+	}
+
+	ts := now.UnixNano()
+	if ts <= parent.Timestamp {
+		ts = parent.Timestamp + 1
+	}
+	header.Timestamp = ts
+	header.Bits = bits
+	header.Nonce = 0
+	return nil
+}
+
+// NextBits returns the target of the block after parent.
+func (p *PoW) NextBits(chain ChainReader, parent *proto.Header) (uint32, error) {
+	if (int(parent.Height)+1)%p.interval != 0 {
+		return parent.Bits, nil
+	}
+
+	first := parent
+	for i := 0; i < p.interval-1; i++ {
+		header, err := chain.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = header
+	}
+
+	expected := int64(p.blockTime) * int64(p.interval-1)
+	actual := max(parent.Timestamp-first.Timestamp, expected/maxRetargetFactor)
+	actual = min(actual, expected*maxRetargetFactor)
+
+	target := CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(p.limit) > 0 {
+		target = p.limit
+	}
+
+	return BigToCompact(target), nil
+}
+
+// Seal searches a nonce for which the block hash meets its target and signs
+// the block. It gives up with the context's error once ctx is done.
+func (p *PoW) Seal(ctx context.Context, pk *crypto.PrivateKey, b *proto.Block) error {
+	if err := types.SetRootHash(b); err != nil {
+		return err
+	}
+
+	target := CompactToBig(b.Header.Bits)
+	for nonce := uint64(0); ; nonce++ {
+		if nonce%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		b.Header.Nonce = nonce
+		if meetsTarget(types.HashBlock(b), target) {
+			break
+		}
+	}
+	types.SignBlock(pk, b)
+	return nil
+}
+
+func (p *PoW) VerifyHeader(chain ChainReader, parent *proto.Header, b *proto.Block, now time.Time) error {
+	if !types.VerifyBlock(b) {
+		return fmt.Errorf("invalid block signature")
+	}
+	if err := verifyTimestamp(parent, b.Header, now); err != nil {
+		return err
+	}
+
+	bits, err := p.NextBits(chain, parent)
+	if err != nil {
+		return err
+	}
+	if b.Header.Bits != bits {
+		return fmt.Errorf("invalid block bits (%08x) expected (%08x)", b.Header.Bits, bits)
+	}
+	if !meetsTarget(types.HashBlock(b), CompactToBig(bits)) {
+		return fmt.Errorf("block hash does not meet target %08x", bits)
+	}
+	return nil
+}
+
+// Work is the expected number of hashes needed to find a block with the
+// target of header.
+func (p *PoW) Work(header *proto.Header) *big.Int {
+	target := CompactToBig(header.Bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	return target.Div(oneLsh256, target.Add(target, big.NewInt(1)))
+}
+
+// ForkChoice follows the branch with the most accumulated work.
+func (p *PoW) ForkChoice(current, candidate Branch) bool {
+	return candidate.Work.Cmp(current.Work) > 0
+}
+
+func meetsTarget(hash []byte, target *big.Int) bool {
+	return new(big.Int).SetBytes(hash).Cmp(target) <= 0
+}
+
+// CompactToBig decodes a target in the compact form used by bitcoin, the
+// highest byte is the length of the number in bytes and the lower three its
+// most significant bytes.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := int64(compact & 0x007fffff)
+	exponent := uint(compact >> 24)
+
+	if exponent <= 3 {
+		return big.NewInt(mantissa >> (8 * (3 - exponent)))
+	}
+	n := big.NewInt(mantissa)
+	return n.Lsh(n, 8*(exponent-3))
+}
+
+// BigToCompact encodes a non negative target in compact form, dropping all
+// but its three most significant bytes.
+func BigToCompact(n *big.Int) uint32 {
+	if n.Sign() <= 0 {
+		return 0
+	}
+
+	exponent := uint(len(n.Bytes()))
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(n.Uint64()) << (8 * (3 - exponent))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(n, 8*(exponent-3)).Uint64())
+	}
+	// the top bit of the mantissa is a sign bit
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
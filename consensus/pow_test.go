@@ -0,0 +1,177 @@
+package consensus
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+type memoryChain map[string]*proto.Header
+
+func (c memoryChain) GetHeader(hash []byte) (*proto.Header, error) {
+	header, ok := c[hex.EncodeToString(hash)]
+	if !ok {
+		return nil, fmt.Errorf("unknown header %x", hash)
+	}
+	return header, nil
+}
+
+// extend appends n headers spaced by gap to parent without mining them.
+func (c memoryChain) extend(pow *PoW, parent *proto.Header, n int, gap time.Duration) *proto.Header {
+	c[hex.EncodeToString(types.HashHeader(parent))] = parent
+	for i := 0; i < n; i++ {
+		bits, err := pow.NextBits(c, parent)
+		if err != nil {
+			panic(err)
+		}
+		header := &proto.Header{
+			Height:    parent.Height + 1,
+			PrevHash:  types.HashHeader(parent),
+			Timestamp: parent.Timestamp + int64(gap),
+			Bits:      bits,
+		}
+		c[hex.EncodeToString(types.HashHeader(header))] = header
+		parent = header
+	}
+	return parent
+}
+
+func genesisHeader(difficulty int) *proto.Header {
+	return &proto.Header{Timestamp: time.Now().Add(-time.Hour).UnixNano(), Bits: DifficultyToBits(difficulty)}
+}
+
+func TestCompact(t *testing.T) {
+	for _, n := range []*big.Int{big.NewInt(0x12), big.NewInt(0x1234), big.NewInt(0x80), big.NewInt(0x123456789a)} {
+		bits := BigToCompact(n)
+		// only the three most significant bytes survive
+		want := new(big.Int).Set(n)
+		if shift := len(n.Bytes()) - 3; shift > 0 {
+			want.Rsh(want, uint(8*shift))
+			want.Lsh(want, uint(8*shift))
+		}
+		assert.Equal(t, want, CompactToBig(bits), "%x", n)
+	}
+	assert.Equal(t, uint32(0x1d00ffff), BigToCompact(CompactToBig(0x1d00ffff)))
+	assert.Equal(t, uint32(0x02008000), BigToCompact(big.NewInt(0x80)))
+
+	target := CompactToBig(DifficultyToBits(20))
+	assert.Equal(t, 256-20, target.BitLen())
+}
+
+func TestPoWSealVerify(t *testing.T) {
+	pow, err := NewPoW(8, time.Second, 10)
+	require.Nil(t, err)
+	chain := memoryChain{}
+	pk := crypto.GeneratePrivatekey()
+	parent := genesisHeader(8)
+
+	header := &proto.Header{Version: 1, Height: 1, PrevHash: types.HashHeader(parent)}
+	// the timestamp always moves past the parent
+	require.Nil(t, pow.PrepareHeader(chain, parent, header, pk.Public(), time.Unix(0, parent.Timestamp)))
+	assert.Greater(t, header.Timestamp, parent.Timestamp)
+	assert.Equal(t, parent.Bits, header.Bits)
+
+	b := &proto.Block{Header: header}
+	require.Nil(t, pow.Seal(context.Background(), pk, b))
+	assert.True(t, meetsTarget(types.HashBlock(b), CompactToBig(b.Header.Bits)))
+	assert.Nil(t, pow.VerifyHeader(chain, parent, b, time.Now()))
+
+	// an easier target than scheduled is rejected
+	easier := &proto.Block{Header: &proto.Header{Version: 1, Height: 1, PrevHash: header.PrevHash, Timestamp: header.Timestamp, Bits: DifficultyToBits(0)}}
+	require.Nil(t, pow.Seal(context.Background(), pk, easier))
+	assert.ErrorContains(t, pow.VerifyHeader(chain, parent, easier, time.Now()), "bits")
+
+	// any other nonce almost certainly misses the target
+	b.Header.Nonce++
+	for meetsTarget(types.HashBlock(b), CompactToBig(b.Header.Bits)) {
+		b.Header.Nonce++
+	}
+	types.SignBlock(pk, b)
+	assert.ErrorContains(t, pow.VerifyHeader(chain, parent, b, time.Now()), "target")
+}
+
+func TestPoWSealCancel(t *testing.T) {
+	pow, err := NewPoW(0, time.Second, 10)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b := &proto.Block{Header: &proto.Header{Version: 1, Bits: DifficultyToBits(255)}}
+	assert.ErrorIs(t, pow.Seal(ctx, crypto.GeneratePrivatekey(), b), context.Canceled)
+
+	_, err = NewPoW(256, time.Second, 10)
+	assert.NotNil(t, err)
+	_, err = NewPoW(8, 0, 10)
+	assert.NotNil(t, err)
+	_, err = NewPoW(8, time.Second, 1)
+	assert.NotNil(t, err)
+}
+
+func TestPoWRetarget(t *testing.T) {
+	pow, err := NewPoW(8, time.Second, 10)
+	require.Nil(t, err)
+	genesis := genesisHeader(8)
+	limit := CompactToBig(genesis.Bits)
+
+	// blocks twice as fast as wanted halve the target at height 10
+	chain := memoryChain{}
+	tip := chain.extend(pow, genesis, 9, 500*time.Millisecond)
+	bits, err := pow.NextBits(chain, tip)
+	require.Nil(t, err)
+	want := new(big.Int).Div(limit, big.NewInt(2))
+	assert.Equal(t, BigToCompact(want), bits)
+	// and keep it until the next retarget
+	tip = chain.extend(pow, tip, 9, time.Second)
+	next, err := pow.NextBits(chain, tip)
+	require.Nil(t, err)
+	assert.Equal(t, bits, next)
+
+	// very fast blocks only make it four times harder
+	chain = memoryChain{}
+	tip = chain.extend(pow, genesis, 9, time.Millisecond)
+	bits, err = pow.NextBits(chain, tip)
+	require.Nil(t, err)
+	want = new(big.Int).Div(limit, big.NewInt(4))
+	assert.Equal(t, BigToCompact(want), bits)
+
+	// slow blocks can't make it easier than the genesis difficulty
+	chain = memoryChain{}
+	tip = chain.extend(pow, genesis, 9, time.Minute)
+	bits, err = pow.NextBits(chain, tip)
+	require.Nil(t, err)
+	assert.Equal(t, genesis.Bits, bits)
+
+	// retargeting needs the whole interval
+	_, err = pow.NextBits(memoryChain{}, tip)
+	assert.NotNil(t, err)
+}
+
+func TestForkChoice(t *testing.T) {
+	pow, err := NewPoW(8, time.Second, 10)
+	require.Nil(t, err)
+
+	easy := &proto.Header{Height: 6, Bits: DifficultyToBits(8)}
+	hard := &proto.Header{Height: 5, Bits: DifficultyToBits(12)}
+	assert.Equal(t, 0, new(big.Int).Mul(pow.Work(easy), big.NewInt(16)).Cmp(pow.Work(hard)))
+
+	// a shorter branch with more work wins
+	current := Branch{Header: easy, Work: new(big.Int).Mul(pow.Work(easy), big.NewInt(6))}
+	candidate := Branch{Header: hard, Work: new(big.Int).Mul(pow.Work(hard), big.NewInt(5))}
+	assert.True(t, pow.ForkChoice(current, candidate))
+	assert.False(t, pow.ForkChoice(candidate, current))
+	assert.False(t, pow.ForkChoice(current, current))
+
+	poa, _ := makePoA(t, 1)
+	assert.Equal(t, big.NewInt(1), poa.Work(easy))
+	assert.False(t, poa.ForkChoice(current, candidate))
+	assert.True(t, poa.ForkChoice(candidate, current))
+}
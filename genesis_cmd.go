@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wvalencia19/blocker/node"
+)
+
+// listFlag collects the values of a flag given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func runGenesisInit(args []string) error {
+	var allocs, validators listFlag
+	flags := flag.NewFlagSet("genesis init", flag.ExitOnError)
+	out := flags.String("out", "genesis.json", "file to write the genesis to")
+	chainID := flags.String("chain-id", "", "identifier of the network")
+	engine := flags.String("engine", node.EnginePoA, "consensus engine, poa, pow or bft")
+	blockTime := flags.Duration("block-time", 5*time.Second, "length of a validator slot")
+	difficulty := flags.Int("difficulty", 16, "leading zero bits of proof of work block hashes")
+	subsidy := flags.Int64("subsidy", 50, "new coins paid to the producer of every block")
+	retarget := flags.Int("retarget-interval", 0, "blocks between proof of work retargets, 0 for the default")
+	flags.Var(&allocs, "alloc", "initial funds as <address>=<amount>, can be repeated")
+	flags.Var(&validators, "validator", "hex encoded public key of a validator, can be repeated")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	g := &node.Genesis{
+		ChainID:   *chainID,
+		Timestamp: time.Now().UTC().Truncate(time.Second),
+		Engine:    *engine,
+		BlockTime: node.Duration{Duration: *blockTime},
+		Subsidy:   *subsidy,
+		Alloc:     []node.Allocation{},
+	}
+	if *engine == node.EnginePoW {
+		g.Difficulty = *difficulty
+		g.RetargetInterval = *retarget
+	}
+	for _, alloc := range allocs {
+		addr, amount, ok := strings.Cut(alloc, "=")
+		if !ok {
+			return fmt.Errorf("invalid alloc %q, expected <address>=<amount>", alloc)
+		}
+		n, err := strconv.ParseInt(amount, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid alloc %q: %w", alloc, err)
+		}
+		g.Alloc = append(g.Alloc, node.Allocation{Address: addr, Amount: n})
+	}
+	for _, pubKey := range validators {
+		g.Validators = append(g.Validators, node.GenesisValidator{PublicKey: pubKey})
+	}
+
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	if err := g.Save(*out); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote genesis of chain %s to %s\n", g.ChainID, *out)
+	return nil
+}
@@ -3,17 +3,18 @@ module github.com/wvalencia19/blocker
 go 1.21.7
 
 require (
+	github.com/cbergoon/merkletree v0.2.0
 	github.com/stretchr/testify v1.9.0
+	go.etcd.io/bbolt v1.3.10
+	go.uber.org/zap v1.19.1
 	google.golang.org/protobuf v1.33.0
 )
 
 require (
-	github.com/cbergoon/merkletree v0.2.0 // indirect
 	github.com/go-kit/log v0.2.0 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
 	go.uber.org/atomic v1.9.0 // indirect
 	go.uber.org/multierr v1.7.0 // indirect
-	go.uber.org/zap v1.19.1 // indirect
 )
 
 require (
@@ -25,6 +26,6 @@ require (
 	golang.org/x/sys v0.16.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240123012728-ef4313101c80 // indirect
-	google.golang.org/grpc v1.62.1 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	google.golang.org/grpc v1.62.1
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,74 +1,50 @@
 package main
 
 import (
-	"context"
-	"log"
-	"time"
-
-	"github.com/wvalencia19/blocker/crypto"
-	"github.com/wvalencia19/blocker/node"
-	"github.com/wvalencia19/blocker/proto"
-	"github.com/wvalencia19/blocker/util"
-	"google.golang.org/grpc"
+	"fmt"
+	"os"
 )
 
-func main() {
-	makeNode(":3000", []string{}, true)
-	time.Sleep(time.Second)
-	makeNode(":4000", []string{":3000"}, false)
-
-	time.Sleep(time.Second)
-	makeNode(":5001", []string{":4000"}, false)
-
-	for {
-		time.Sleep(time.Millisecond * 800)
-		makeTransaction()
-	}
-	select {}
-
+const usage = `usage: blocker <command> [arguments]
+
+commands:
+  node start      run a node
+  key new         generate a validator key
+  genesis init    write the genesis file of a new network
+  wallet new      add a new key to a wallet
+  wallet balance  show the balance of a wallet
+  wallet send     send funds from a wallet
+  chain block     show a block by height or hash
+  tx get          show a transaction by hash
+
+run "blocker <command> -h" for the arguments of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"node start":     runNodeStart,
+	"key new":        runKeyNew,
+	"genesis init":   runGenesisInit,
+	"wallet new":     runWalletNew,
+	"wallet balance": runWalletBalance,
+	"wallet send":    runWalletSend,
+	"chain block":    runChainBlock,
+	"tx get":         runTxGet,
 }
 
-func makeNode(listedAddr string, bootstrapNodes []string, isValidator bool) *node.Node {
-	cfg := node.ServerConfig{
-		Version:    "Blocker-1",
-		ListenAddr: listedAddr,
-	}
-	if isValidator {
-		cfg.PrivateKey = crypto.GeneratePrivatekey()
-	}
-	n := node.NewNode(cfg)
-	go n.Start(listedAddr, bootstrapNodes)
-
-	return n
-}
-
-func makeTransaction() {
-	client, err := grpc.Dial(":3000", grpc.WithInsecure())
-	if err != nil {
-		log.Fatal(err)
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
 	}
 
-	c := proto.NewNodeClient(client)
-	privKey := crypto.GeneratePrivatekey()
-	tx := &proto.Transaction{
-		Version: 1,
-		Inputs: []*proto.TxInput{
-			{
-				PrevTxHash:   util.RandomHash(),
-				PrevOutIndex: 0,
-				PublicKey:    privKey.Public().Bytes(),
-			},
-		},
-		Outputs: []*proto.TxOutput{
-			{
-				Amount:  99,
-				Address: privKey.Public().Address().Bytes(),
-			},
-		},
+	run, ok := commands[os.Args[1]+" "+os.Args[2]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1]+" "+os.Args[2], usage)
+		os.Exit(2)
 	}
 
-	_, err = c.HandleTransaction(context.TODO(), tx)
-	if err != nil {
-		log.Fatal(err)
+	if err := run(os.Args[3:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
 	}
 }
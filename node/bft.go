@@ -0,0 +1,298 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/wvalencia19/blocker/consensus"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// voteRound identifies a round of voting on the block at a height.
+type voteRound struct {
+	height int
+	round  int
+}
+
+// bftState keeps the votes for the heights that aren't final yet and what
+// the node voted for itself.
+type bftState struct {
+	lock       sync.Mutex
+	prevotes   map[voteRound]*consensus.VoteSet
+	precommits map[voteRound]*consensus.VoteSet
+	// proposals holds the hash of the block proposed in each round.
+	proposals    map[voteRound][]byte
+	prevoted     map[voteRound]bool
+	precommitted map[voteRound]bool
+	// locked is the block we last precommitted and the round we did it in.
+	// Until a later round gets a quorum of prevotes for another block we
+	// only prevote for the locked one, which keeps two different blocks
+	// from being finalized at the same height.
+	locked      []byte
+	lockedRound voteRound
+}
+
+func newBFTState() *bftState {
+	return &bftState{
+		prevotes:     make(map[voteRound]*consensus.VoteSet),
+		precommits:   make(map[voteRound]*consensus.VoteSet),
+		proposals:    make(map[voteRound][]byte),
+		prevoted:     make(map[voteRound]bool),
+		precommitted: make(map[voteRound]bool),
+	}
+}
+
+func (s *bftState) hasProposal(r voteRound) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, ok := s.proposals[r]
+	return ok
+}
+
+// prune forgets everything about the heights up to the finalized one.
+func (s *bftState) prune(finalized int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, m := range []map[voteRound]*consensus.VoteSet{s.prevotes, s.precommits} {
+		for r := range m {
+			if r.height <= finalized {
+				delete(m, r)
+			}
+		}
+	}
+	for _, m := range []map[voteRound]bool{s.prevoted, s.precommitted} {
+		for r := range m {
+			if r.height <= finalized {
+				delete(m, r)
+			}
+		}
+	}
+	for r := range s.proposals {
+		if r.height <= finalized {
+			delete(s.proposals, r)
+		}
+	}
+	if s.lockedRound.height <= finalized {
+		s.locked = nil
+		s.lockedRound = voteRound{}
+	}
+}
+
+func (n *Node) bftEngine() (*consensus.BFT, bool) {
+	engine, ok := n.chain.Consensus().(*consensus.BFT)
+	return engine, ok
+}
+
+func (n *Node) isValidator(engine *consensus.BFT) bool {
+	return n.PrivateKey != nil && engine.IsValidator(n.PrivateKey.Public())
+}
+
+// onBlock is called for every block added to the chain. With BFT the block
+// is the proposal of its round, validators prevote for it when it made it
+// to the tip of the chain, which means its transactions are valid.
+func (n *Node) onBlock(b *proto.Block) {
+	engine, ok := n.bftEngine()
+	if !ok {
+		return
+	}
+	parent, err := n.chain.GetHeader(b.Header.PrevHash)
+	if err != nil {
+		n.logger.Errorw("block without parent", "err", err)
+		return
+	}
+
+	hash := types.HashBlock(b)
+	r := voteRound{height: int(b.Header.Height), round: engine.Round(parent, b.Header.Timestamp)}
+	tip := types.HashHeader(n.chain.Tip())
+
+	n.bft.lock.Lock()
+	n.bft.proposals[r] = hash
+	prevote := n.isValidator(engine) && bytes.Equal(tip, hash) && !n.bft.prevoted[r]
+	if n.bft.locked != nil && n.bft.lockedRound.height == r.height && !bytes.Equal(n.bft.locked, hash) {
+		prevote = false
+	}
+	if prevote {
+		n.bft.prevoted[r] = true
+	}
+	n.bft.lock.Unlock()
+
+	if prevote {
+		n.castVote(proto.VoteType_PREVOTE, r, hash)
+	}
+	// precommits may have arrived before the block did
+	n.commitPending()
+}
+
+// castVote signs our vote, counts it and sends it to our peers.
+func (n *Node) castVote(voteType proto.VoteType, r voteRound, hash []byte) {
+	v := &proto.Vote{
+		Type:      voteType,
+		Height:    int32(r.height),
+		Round:     int64(r.round),
+		BlockHash: hash,
+		ChainID:   n.chain.Genesis().ChainID,
+	}
+	types.SignVote(n.PrivateKey, v)
+
+	if _, err := n.handleVote(v); err != nil {
+		n.logger.Errorw("vote error", "err", err)
+		return
+	}
+	go func() {
+		if err := n.broadcast(v); err != nil {
+			n.logger.Errorw("broadcast error", "err", err)
+		}
+	}()
+}
+
+// handleVote counts a vote, it reports false for votes we already had or
+// that are about final heights. A quorum of prevotes makes validators
+// precommit, a quorum of precommits finalizes the block.
+func (n *Node) handleVote(v *proto.Vote) (bool, error) {
+	engine, ok := n.bftEngine()
+	if !ok {
+		return false, fmt.Errorf("consensus engine doesn't vote")
+	}
+	if chainID := n.chain.Genesis().ChainID; v.ChainID != chainID {
+		return false, fmt.Errorf("vote of chain %q, expected %q", v.ChainID, chainID)
+	}
+	if int(v.Height) <= n.chain.FinalizedHeight() {
+		return false, nil
+	}
+
+	r := voteRound{height: int(v.Height), round: int(v.Round)}
+	n.bft.lock.Lock()
+	sets := n.bft.prevotes
+	if v.Type == proto.VoteType_PRECOMMIT {
+		sets = n.bft.precommits
+	}
+	set, ok := sets[r]
+	if !ok {
+		set = consensus.NewVoteSet(engine, v.Type, r.height, r.round)
+		sets[r] = set
+	}
+	added, err := set.Add(v)
+	if err != nil || !added {
+		n.bft.lock.Unlock()
+		return false, err
+	}
+
+	var precommit []byte
+	var cert *proto.CommitCertificate
+	switch v.Type {
+	case proto.VoteType_PREVOTE:
+		hash, ok := set.Majority()
+		stale := n.bft.locked != nil && n.bft.lockedRound.height == r.height && r.round < n.bft.lockedRound.round
+		if ok && !stale && n.isValidator(engine) && !n.bft.precommitted[r] {
+			n.bft.precommitted[r] = true
+			n.bft.locked = hash
+			n.bft.lockedRound = r
+			precommit = hash
+		}
+	case proto.VoteType_PRECOMMIT:
+		cert, _ = set.Certificate()
+	}
+	n.bft.lock.Unlock()
+
+	if precommit != nil {
+		n.castVote(proto.VoteType_PRECOMMIT, r, precommit)
+	}
+	if cert != nil {
+		n.finalize(cert)
+	}
+
+	return true, nil
+}
+
+// commitPending finalizes the highest block we have a quorum of precommits
+// for, in case they showed up before the block.
+func (n *Node) commitPending() {
+	n.bft.lock.Lock()
+	var best *proto.CommitCertificate
+	for _, set := range n.bft.precommits {
+		if cert, ok := set.Certificate(); ok && (best == nil || cert.Height > best.Height) {
+			best = cert
+		}
+	}
+	n.bft.lock.Unlock()
+
+	if best != nil && n.chain.HasBlock(best.BlockHash) {
+		n.finalize(best)
+	}
+}
+
+func (n *Node) finalize(cert *proto.CommitCertificate) {
+	if int(cert.Height) <= n.chain.FinalizedHeight() {
+		return
+	}
+	if err := n.chain.Finalize(cert); err != nil {
+		n.logger.Debugw("can't finalize block", "hash", hex.EncodeToString(cert.BlockHash), "err", err)
+		return
+	}
+	n.bft.prune(int(cert.Height))
+	n.logger.Infow("finalized block", "height", cert.Height, "hash", hex.EncodeToString(cert.BlockHash), "we", n.ListenAddr)
+}
+
+// syncCommits asks the peer for the commit certificate of the highest block
+// above our finalized height it has one for.
+func (n *Node) syncCommits(c proto.NodeClient) {
+	if _, ok := n.bftEngine(); !ok {
+		return
+	}
+
+	for height := n.chain.Height(); height > n.chain.FinalizedHeight(); height-- {
+		header, err := n.chain.HeaderAt(height)
+		if err != nil {
+			continue
+		}
+		cert, err := c.GetCommit(context.Background(), &proto.BlockQuery{Hash: types.HashHeader(header)})
+		if err != nil {
+			continue
+		}
+		n.finalize(cert)
+		return
+	}
+}
+
+func (n *Node) receiveVote(v *proto.Vote, voteType proto.VoteType) (*proto.Ack, error) {
+	if v.Type != voteType {
+		return nil, fmt.Errorf("got a %s, expected a %s", v.Type, voteType)
+	}
+	added, err := n.handleVote(v)
+	if err != nil {
+		return nil, err
+	}
+	if added {
+		go func() {
+			if err := n.broadcast(v); err != nil {
+				n.logger.Errorw("broadcast error", "err", err)
+			}
+		}()
+	}
+
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) HandlePrevote(ctx context.Context, v *proto.Vote) (*proto.Ack, error) {
+	return n.receiveVote(v, proto.VoteType_PREVOTE)
+}
+
+func (n *Node) HandlePrecommit(ctx context.Context, v *proto.Vote) (*proto.Ack, error) {
+	return n.receiveVote(v, proto.VoteType_PRECOMMIT)
+}
+
+// GetCommit returns the commit certificate of a final block, looked up like
+// GetBlock does.
+func (n *Node) GetCommit(ctx context.Context, q *proto.BlockQuery) (*proto.CommitCertificate, error) {
+	b, err := n.GetBlock(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return n.chain.GetCommit(types.HashBlock(b))
+}
@@ -0,0 +1,114 @@
+package node
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/consensus"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// bftGenesis is the development network run by the given validators with
+// the BFT engine.
+func bftGenesis(keys ...*crypto.PrivateKey) *Genesis {
+	g := DefaultGenesis()
+	g.Engine = EngineBFT
+	g.BlockTime = Duration{time.Microsecond}
+	g.Validators = nil
+	for _, pk := range keys {
+		g.Validators = append(g.Validators, GenesisValidator{PublicKey: hex.EncodeToString(pk.Public().Bytes())})
+	}
+	return g
+}
+
+func vote(pk *crypto.PrivateKey, voteType proto.VoteType, b *proto.Block, round int) *proto.Vote {
+	v := &proto.Vote{
+		Type:      voteType,
+		Height:    b.Header.Height,
+		Round:     int64(round),
+		BlockHash: types.HashBlock(b),
+		ChainID:   b.Header.ChainID,
+	}
+	types.SignVote(pk, v)
+	return v
+}
+
+func TestBFTSingleValidator(t *testing.T) {
+	n := makeNodeWithGenesis(t, bftGenesis(crypto.NewPrivateKeyFromSeedStr(godSeed)), crypto.NewPrivateKeyFromSeedStr(godSeed))
+
+	// a lone validator is its own quorum
+	require.Nil(t, n.produceBlock())
+	require.Nil(t, n.produceBlock())
+	assert.Equal(t, 2, n.chain.Height())
+	assert.Equal(t, 2, n.chain.FinalizedHeight())
+
+	c := serveNode(t, n)
+	v, err := c.GetVersion(context.Background(), &proto.Ack{})
+	require.Nil(t, err)
+	assert.Equal(t, int32(2), v.FinalizedHeight)
+
+	observer := makeNodeWithGenesis(t, bftGenesis(crypto.NewPrivateKeyFromSeedStr(godSeed)), nil)
+	require.Nil(t, observer.syncBlocks(c))
+	assert.Equal(t, 2, observer.chain.FinalizedHeight())
+}
+
+func TestBFTVoting(t *testing.T) {
+	keys := []*crypto.PrivateKey{crypto.GeneratePrivatekey(), crypto.GeneratePrivatekey(), crypto.GeneratePrivatekey(), crypto.GeneratePrivatekey()}
+	g := bftGenesis(keys...)
+	// long enough a slot for the validator to produce in it after waiting
+	g.BlockTime = Duration{50 * time.Millisecond}
+	validator := makeNodeWithGenesis(t, g, keys[1])
+	observer := makeNodeWithGenesis(t, g, nil)
+	ctx := context.Background()
+
+	header, err := validator.prepareHeader()
+	require.Nil(t, err)
+	time.Sleep(time.Until(time.Unix(0, header.Timestamp)))
+	require.Nil(t, validator.produceBlock())
+	b := mustTip(t, validator.chain)
+	genesis, err := validator.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	round := validator.chain.Consensus().(*consensus.BFT).Round(genesis.Header, b.Header.Timestamp)
+	_, err = observer.HandleBlock(ctx, b)
+	require.Nil(t, err)
+
+	// the proposer prevoted, two more prevotes make it precommit
+	for _, pk := range []*crypto.PrivateKey{keys[0], keys[2]} {
+		_, err := validator.HandlePrevote(ctx, vote(pk, proto.VoteType_PREVOTE, b, round))
+		require.Nil(t, err)
+	}
+	_, err = validator.HandlePrevote(ctx, vote(keys[3], proto.VoteType_PRECOMMIT, b, round))
+	assert.NotNil(t, err)
+	_, err = validator.HandlePrevote(ctx, vote(crypto.GeneratePrivatekey(), proto.VoteType_PREVOTE, b, round))
+	assert.NotNil(t, err)
+	assert.True(t, validator.bft.precommitted[voteRound{height: 1, round: round}])
+	assert.Equal(t, 0, validator.chain.FinalizedHeight())
+
+	_, err = validator.HandlePrecommit(ctx, vote(keys[0], proto.VoteType_PRECOMMIT, b, round))
+	require.Nil(t, err)
+	assert.Equal(t, 0, validator.chain.FinalizedHeight())
+	_, err = validator.HandlePrecommit(ctx, vote(keys[2], proto.VoteType_PRECOMMIT, b, round))
+	require.Nil(t, err)
+	assert.Equal(t, 1, validator.chain.FinalizedHeight())
+
+	// observers only count votes
+	assert.Empty(t, observer.bft.prevoted)
+	for _, pk := range keys[:2] {
+		_, err := observer.HandlePrecommit(ctx, vote(pk, proto.VoteType_PRECOMMIT, b, round))
+		require.Nil(t, err)
+	}
+	assert.Equal(t, 0, observer.chain.FinalizedHeight())
+	_, err = observer.HandlePrecommit(ctx, vote(keys[3], proto.VoteType_PRECOMMIT, b, round))
+	require.Nil(t, err)
+	assert.Equal(t, 1, observer.chain.FinalizedHeight())
+
+	cert, err := observer.GetCommit(ctx, &proto.BlockQuery{Height: 1})
+	require.Nil(t, err)
+	assert.Len(t, cert.Precommits, 3)
+}
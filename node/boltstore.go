@@ -0,0 +1,355 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	bolt "go.etcd.io/bbolt"
+	pb "google.golang.org/protobuf/proto"
+)
+
+var (
+	blocksBucket  = []byte("blocks")
+	commitsBucket = []byte("commits")
+	chainBucket   = []byte("chain")
+	txxBucket     = []byte("txx")
+	utxosBucket   = []byte("utxos")
+	// unspentBucket indexes unspent outputs as "<address>/<utxo key>"
+	unspentBucket = []byte("unspent")
+
+	tipKey = []byte("tip")
+)
+
+// OpenDB opens the database holding the chain inside dataDir, creating
+// both of them when they don't exist yet.
+func OpenDB(dataDir string) (*bolt.DB, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	return bolt.Open(filepath.Join(dataDir, "chain.db"), 0600, &bolt.Options{Timeout: time.Second})
+}
+
+func createBuckets(db *bolt.DB, names ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type BoltBlockStore struct {
+	db *bolt.DB
+}
+
+func NewBoltBlockStore(db *bolt.DB) (*BoltBlockStore, error) {
+	if err := createBuckets(db, blocksBucket, commitsBucket, chainBucket); err != nil {
+		return nil, err
+	}
+
+	return &BoltBlockStore{
+		db: db,
+	}, nil
+}
+
+func (s *BoltBlockStore) Get(hash string) (*proto.Block, error) {
+	block := &proto.Block{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blocksBucket).Get([]byte(hash))
+		if b == nil {
+			return fmt.Errorf("block with hash [%s] does not exists", hash)
+		}
+		return pb.Unmarshal(b, block)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+func (s *BoltBlockStore) Put(b *proto.Block) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBlock(tx, b)
+	})
+}
+
+func putBlock(tx *bolt.Tx, b *proto.Block) error {
+	data, err := pb.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	hash := hex.EncodeToString(types.HashBlock(b))
+	return tx.Bucket(blocksBucket).Put([]byte(hash), data)
+}
+
+func (s *BoltBlockStore) Tip() (string, error) {
+	var hash string
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket(chainBucket).Get(tipKey)
+		if tip == nil {
+			return ErrNoTip
+		}
+		hash = string(tip)
+		return nil
+	})
+
+	return hash, err
+}
+
+func (s *BoltBlockStore) SetTip(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chainBucket).Put(tipKey, []byte(hash))
+	})
+}
+
+func (s *BoltBlockStore) PutCommit(cert *proto.CommitCertificate) error {
+	data, err := pb.Marshal(cert)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(commitsBucket).Put([]byte(hex.EncodeToString(cert.BlockHash)), data)
+	})
+}
+
+func (s *BoltBlockStore) GetCommit(hash string) (*proto.CommitCertificate, error) {
+	cert := &proto.CommitCertificate{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commitsBucket).Get([]byte(hash))
+		if b == nil {
+			return fmt.Errorf("no commit certificate for block [%s]", hash)
+		}
+		return pb.Unmarshal(b, cert)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, nil
+}
+
+type BoltTXStore struct {
+	db *bolt.DB
+}
+
+func NewBoltTXStore(db *bolt.DB) (*BoltTXStore, error) {
+	if err := createBuckets(db, txxBucket); err != nil {
+		return nil, err
+	}
+
+	return &BoltTXStore{
+		db: db,
+	}, nil
+}
+
+func (s *BoltTXStore) Get(hash string) (*proto.Transaction, error) {
+	tx := &proto.Transaction{}
+
+	err := s.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket(txxBucket).Get([]byte(hash))
+		if b == nil {
+			return fmt.Errorf("could not find tx with hash %s", hash)
+		}
+		return pb.Unmarshal(b, tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+func (s *BoltTXStore) Put(tx *proto.Transaction) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return putTransaction(btx, tx)
+	})
+}
+
+func (s *BoltTXStore) Delete(hash string) error {
+	return s.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(txxBucket).Delete([]byte(hash))
+	})
+}
+
+func putTransaction(btx *bolt.Tx, tx *proto.Transaction) error {
+	data, err := pb.Marshal(tx)
+	if err != nil {
+		return err
+	}
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	return btx.Bucket(txxBucket).Put([]byte(hash), data)
+}
+
+type BoltUTXOStore struct {
+	db *bolt.DB
+}
+
+func NewBoltUTXOStore(db *bolt.DB) (*BoltUTXOStore, error) {
+	if err := createBuckets(db, utxosBucket, unspentBucket); err != nil {
+		return nil, err
+	}
+
+	return &BoltUTXOStore{
+		db: db,
+	}, nil
+}
+
+func unspentKey(address, key string) []byte {
+	return []byte(address + "/" + key)
+}
+
+func (s *BoltUTXOStore) Get(hash string) (*UTXO, error) {
+	utxo := &UTXO{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(utxosBucket).Get([]byte(hash))
+		if b == nil {
+			return fmt.Errorf("could not find utxo with hash %s", hash)
+		}
+		return json.Unmarshal(b, utxo)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return utxo, nil
+}
+
+func (s *BoltUTXOStore) Put(utxo *UTXO) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putUTXO(tx, utxo)
+	})
+}
+
+func putUTXO(tx *bolt.Tx, utxo *UTXO) error {
+	data, err := json.Marshal(utxo)
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s_%d", utxo.Hash, utxo.OutIndex)
+	if err := tx.Bucket(utxosBucket).Put([]byte(key), data); err != nil {
+		return err
+	}
+
+	if utxo.Spent {
+		return tx.Bucket(unspentBucket).Delete(unspentKey(utxo.Address, key))
+	}
+	return tx.Bucket(unspentBucket).Put(unspentKey(utxo.Address, key), []byte{})
+}
+
+func (s *BoltUTXOStore) Delete(hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteUTXO(tx, hash)
+	})
+}
+
+func deleteUTXO(tx *bolt.Tx, hash string) error {
+	b := tx.Bucket(utxosBucket).Get([]byte(hash))
+	if b == nil {
+		return nil
+	}
+
+	utxo := &UTXO{}
+	if err := json.Unmarshal(b, utxo); err != nil {
+		return err
+	}
+	if err := tx.Bucket(unspentBucket).Delete(unspentKey(utxo.Address, hash)); err != nil {
+		return err
+	}
+
+	return tx.Bucket(utxosBucket).Delete([]byte(hash))
+}
+
+func (s *BoltUTXOStore) ListUnspent(address string) ([]*UTXO, error) {
+	utxos := []*UTXO{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(address + "/")
+		c := tx.Bucket(unspentBucket).Cursor()
+
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			utxo := &UTXO{}
+			b := tx.Bucket(utxosBucket).Get(k[len(prefix):])
+			if err := json.Unmarshal(b, utxo); err != nil {
+				return err
+			}
+			utxos = append(utxos, utxo)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return utxos, nil
+}
+
+// sharedBoltDB returns the database of the stores when they are all bolt
+// stores kept in the same one, nil otherwise.
+func sharedBoltDB(bs BlockStorer, txStore TXStorer, utxoStore UTXOStorer) *bolt.DB {
+	blocks, ok := bs.(*BoltBlockStore)
+	if !ok {
+		return nil
+	}
+	txx, ok := txStore.(*BoltTXStore)
+	if !ok || txx.db != blocks.db {
+		return nil
+	}
+	utxos, ok := utxoStore.(*BoltUTXOStore)
+	if !ok || utxos.db != blocks.db {
+		return nil
+	}
+	return blocks.db
+}
+
+// commitUpdate applies u in a single transaction of db, a crash leaves the
+// chain either before or after the block, never in between.
+func commitUpdate(db *bolt.DB, u *storeUpdate) error {
+	return db.Update(func(btx *bolt.Tx) error {
+		for _, hash := range u.deleted {
+			if err := btx.Bucket(txxBucket).Delete([]byte(hash)); err != nil {
+				return err
+			}
+		}
+		for _, tx := range u.txx {
+			if err := putTransaction(btx, tx); err != nil {
+				return err
+			}
+		}
+		for key, utxo := range u.utxos {
+			var err error
+			if utxo == nil {
+				err = deleteUTXO(btx, key)
+			} else {
+				err = putUTXO(btx, utxo)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if u.block != nil {
+			if err := putBlock(btx, u.block); err != nil {
+				return err
+			}
+		}
+		return btx.Bucket(chainBucket).Put(tipKey, []byte(u.tip))
+	})
+}
@@ -0,0 +1,196 @@
+package node
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openBoltChain(t *testing.T, dataDir string) (*Chain, *bolt.DB) {
+	db, err := OpenDB(dataDir)
+	require.Nil(t, err)
+
+	bs, err := NewBoltBlockStore(db)
+	require.Nil(t, err)
+	txStore, err := NewBoltTXStore(db)
+	require.Nil(t, err)
+	utxoStore, err := NewBoltUTXOStore(db)
+	require.Nil(t, err)
+
+	chain, err := OpenChain(bs, txStore, utxoStore, DefaultGenesis())
+	require.Nil(t, err)
+	return chain, db
+}
+
+func TestBoltChainReopen(t *testing.T) {
+	dataDir := t.TempDir()
+	chain, db := openBoltChain(t, dataDir)
+
+	tx := genesisSpend(t, chain)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	b := childBlock(t, genesis, tx)
+	require.Nil(t, chain.AddBlock(b))
+	for i := 0; i < 5; i++ {
+		require.Nil(t, chain.AddBlock(RandomBlock(t, chain)))
+	}
+	tip, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+	require.Nil(t, db.Close())
+
+	chain, db = openBoltChain(t, dataDir)
+	defer db.Close()
+
+	assert.Equal(t, 6, chain.Height())
+	fetched, err := chain.GetBlockByHeight(6)
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(tip), types.HashBlock(fetched))
+	fetched, err = chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(b), types.HashBlock(fetched))
+
+	txHash := hex.EncodeToString(types.HashTransaction(tx))
+	_, err = chain.txStore.Get(txHash)
+	assert.Nil(t, err)
+
+	genesisKey := fmt.Sprintf("%s_0", hex.EncodeToString(types.HashTransaction(genesis.Transactions[0])))
+	utxo, err := chain.utxoStore.Get(genesisKey)
+	require.Nil(t, err)
+	assert.True(t, utxo.Spent)
+	utxo, err = chain.utxoStore.Get(fmt.Sprintf("%s_0", txHash))
+	require.Nil(t, err)
+	assert.False(t, utxo.Spent)
+	assert.Equal(t, int64(1000), utxo.Amount)
+
+	require.Nil(t, chain.AddBlock(RandomBlock(t, chain)))
+	assert.Equal(t, 7, chain.Height())
+}
+
+func TestBoltUTXOStoreDelete(t *testing.T) {
+	db, err := OpenDB(t.TempDir())
+	require.Nil(t, err)
+	defer db.Close()
+
+	store, err := NewBoltUTXOStore(db)
+	require.Nil(t, err)
+
+	utxo := &UTXO{Hash: "aa", OutIndex: 1, Amount: 10, Address: "cafe"}
+	require.Nil(t, store.Put(utxo))
+	fetched, err := store.Get("aa_1")
+	require.Nil(t, err)
+	assert.Equal(t, utxo, fetched)
+
+	utxos, err := store.ListUnspent("cafe")
+	require.Nil(t, err)
+	assert.Equal(t, []*UTXO{utxo}, utxos)
+
+	require.Nil(t, store.Delete("aa_1"))
+	_, err = store.Get("aa_1")
+	assert.NotNil(t, err)
+	utxos, err = store.ListUnspent("cafe")
+	require.Nil(t, err)
+	assert.Empty(t, utxos)
+}
+
+func TestBoltUTXOStoreListUnspent(t *testing.T) {
+	db, err := OpenDB(t.TempDir())
+	require.Nil(t, err)
+	defer db.Close()
+
+	store, err := NewBoltUTXOStore(db)
+	require.Nil(t, err)
+
+	spent := &UTXO{Hash: "aa", OutIndex: 0, Amount: 10, Address: "cafe"}
+	unspent := &UTXO{Hash: "bb", OutIndex: 2, Amount: 20, Address: "cafe"}
+	other := &UTXO{Hash: "cc", OutIndex: 0, Amount: 30, Address: "cafebabe"}
+	for _, utxo := range []*UTXO{spent, unspent, other} {
+		require.Nil(t, store.Put(utxo))
+	}
+	spent.Spent = true
+	require.Nil(t, store.Put(spent))
+
+	utxos, err := store.ListUnspent("cafe")
+	require.Nil(t, err)
+	assert.Equal(t, []*UTXO{unspent}, utxos)
+}
+
+type brokenBlockStore struct {
+	*MemoryBlockStore
+}
+
+func (s brokenBlockStore) Tip() (string, error) {
+	return "", fmt.Errorf("disk on fire")
+}
+
+func TestOpenChainTipError(t *testing.T) {
+	_, err := OpenChain(brokenBlockStore{NewMemoryBlockStore()}, NewMemoryTXStore(), NewMemoryUTXOStore(), DefaultGenesis())
+	assert.ErrorContains(t, err, "disk on fire")
+}
+
+func TestBoltChainCommitsBlocksAtOnce(t *testing.T) {
+	chain, db := openBoltChain(t, t.TempDir())
+	defer db.Close()
+	require.Equal(t, db, sharedBoltDB(chain.blockStore, chain.txStore, chain.utxoStore))
+	assert.Nil(t, sharedBoltDB(chain.blockStore, NewMemoryTXStore(), chain.utxoStore))
+
+	// a failing update leaves the stores untouched, tip included
+	require.Nil(t, db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(utxosBucket).Put([]byte("corrupt_0"), []byte("{"))
+	}))
+	tip := chain.tipHash()
+	tx := genesisSpend(t, chain)
+	u := newStoreUpdate()
+	u.txx = append(u.txx, tx)
+	u.block = RandomBlock(t, chain)
+	u.utxos["corrupt_0"] = nil
+	u.tip = hex.EncodeToString(types.HashBlock(u.block))
+	assert.NotNil(t, commitUpdate(db, u))
+
+	stored, err := chain.blockStore.Tip()
+	require.Nil(t, err)
+	assert.Equal(t, tip, stored)
+	assert.False(t, chain.HasBlock(types.HashBlock(u.block)))
+	_, err = chain.GetTransaction(types.HashTransaction(tx))
+	assert.NotNil(t, err)
+}
+
+func TestBoltChainReorgAfterReopen(t *testing.T) {
+	dataDir := t.TempDir()
+	chain, db := openBoltChain(t, dataDir)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	a1 := childBlock(t, genesis)
+	a2 := childBlock(t, a1)
+	b1 := childBlock(t, genesis)
+	b1.Header.Timestamp++
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(godSeed), b1)
+	for _, b := range []*proto.Block{a1, a2, b1} {
+		require.Nil(t, chain.AddBlock(b))
+	}
+	require.Nil(t, db.Close())
+
+	// the side branch block is stored but not known anymore, a peer
+	// sending the branch again gets the chain to reorganize
+	chain, db = openBoltChain(t, dataDir)
+	defer db.Close()
+	assert.False(t, chain.HasBlock(types.HashBlock(b1)))
+	assert.True(t, chain.HasBlock(types.HashBlock(a2)))
+
+	b2 := childBlock(t, b1)
+	b3 := childBlock(t, b2)
+	for _, b := range []*proto.Block{b1, b2, b3} {
+		require.Nil(t, chain.AddBlock(b))
+	}
+	assert.Equal(t, 3, chain.Height())
+	tip, err := chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(b1), types.HashBlock(tip))
+}
@@ -1,18 +1,27 @@
 package node
 
 import (
-	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"math/big"
+	"sync"
+	"time"
 
+	"github.com/wvalencia19/blocker/consensus"
 	"github.com/wvalencia19/blocker/crypto"
 	"github.com/wvalencia19/blocker/proto"
 	"github.com/wvalencia19/blocker/types"
 )
 
-const godSeed = "1c0fbc3e5edd3857c5882c88a84c52de0e10c442f6ed818b61a8f0a5971b8653"
+var (
+	ErrUnknownOutput = errors.New("unknown output")
+	ErrOutputSpent   = errors.New("output already spent")
+	ErrTimeLocked    = errors.New("time locked")
+)
 
 type HeaderList struct {
+	lock    sync.RWMutex
 	headers []*proto.Header
 }
 
@@ -22,14 +31,28 @@ func NewHeaderList() *HeaderList {
 	}
 }
 func (list *HeaderList) Add(h *proto.Header) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
 	list.headers = append(list.headers, h)
 }
 
-func (list *HeaderList) Get(index int) *proto.Header {
-	if index > list.Height() {
-		panic("index too high")
+func (list *HeaderList) Get(index int) (*proto.Header, error) {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if index < 0 || index >= len(list.headers) {
+		return nil, fmt.Errorf("no header at height %d, height is %d", index, len(list.headers)-1)
 	}
-	return list.headers[index]
+	return list.headers[index], nil
+}
+
+// Last returns the header at the top of the list.
+func (list *HeaderList) Last() *proto.Header {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	return list.headers[len(list.headers)-1]
 }
 
 func (list *HeaderList) Height() int {
@@ -38,92 +61,527 @@ func (list *HeaderList) Height() int {
 
 // [A, B, C, D, E] len = 5, height = 4
 func (list *HeaderList) Len() int {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
 	return len(list.headers)
 }
 
+// Truncate drops every header above the given height.
+func (list *HeaderList) Truncate(height int) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if height+1 < len(list.headers) {
+		list.headers = list.headers[:height+1]
+	}
+}
+
+// blockNode is an entry of the block tree, it links every block we know
+// about to its parent no matter which branch it is on.
+type blockNode struct {
+	hash   string
+	height int
+	parent *blockNode
+	// work is the total work from genesis up to this block.
+	work *big.Int
+}
+
+func (c *Chain) newBlockNode(header *proto.Header, parent *blockNode) *blockNode {
+	node := &blockNode{
+		hash: hex.EncodeToString(types.HashHeader(header)),
+		work: c.engine.Work(header),
+	}
+	if parent != nil {
+		node.height = parent.height + 1
+		node.parent = parent
+		node.work.Add(node.work, parent.work)
+	}
+	return node
+}
+
 type UTXO struct {
 	Hash     string
 	OutIndex int
 	Amount   int64
-	Spent    bool
+	// Address is the hex encoded address owning the output.
+	Address string
+	Spent   bool
+	// Height is the height of the block confirming the output.
+	Height int
+}
+
+// BlockObserver is told about the blocks joining and leaving the main chain,
+// one at a time as the UTXO set changes, a reorg disconnecting blocks tip
+// first before connecting the new branch. It is called with the chain
+// locked, so it mustn't add blocks itself.
+type BlockObserver interface {
+	BlockConnected(c *Chain, b *proto.Block)
+	BlockDisconnected(c *Chain, b *proto.Block)
 }
+
 type Chain struct {
+	// lock serializes writers so a block is always validated
+	// against the tip it is appended to.
+	lock       sync.Mutex
 	txStore    TXStorer
 	blockStore BlockStorer
 	utxoStore  UTXOStorer
-	headers    *HeaderList
+	// headers holds the main chain, index every block of the tree.
+	headers   *HeaderList
+	index     map[string]*blockNode
+	observers []BlockObserver
+	genesis   *Genesis
+	engine    consensus.Engine
+	// finalized is the last block that can't be reverted, genesis on
+	// engines without finality.
+	finalized *blockNode
 }
 
+// NewChain creates a chain of the development network holding its UTXO set
+// in memory, it is meant to be used with empty stores.
 func NewChain(bs BlockStorer, txStore TXStorer) *Chain {
+	chain, err := OpenChain(bs, txStore, NewMemoryUTXOStore(), DefaultGenesis())
+	if err != nil {
+		panic(err)
+	}
+
+	return chain
+}
+
+// OpenChain loads the chain kept in the given stores. Stores that already
+// hold a chain get their main chain rebuilt from the stored tip, empty ones
+// are initialized with the genesis block. Side branches are not persisted.
+func OpenChain(bs BlockStorer, txStore TXStorer, utxoStore UTXOStorer, genesis *Genesis) (*Chain, error) {
 	chain := &Chain{
 		blockStore: bs,
 		txStore:    txStore,
-		utxoStore:  NewMemoryUTXOStore(),
+		utxoStore:  utxoStore,
 		headers:    NewHeaderList(),
+		index:      make(map[string]*blockNode),
+		genesis:    genesis,
 	}
-	chain.addBlock(CreateGenesisBlock())
 
-	return chain
+	genesisBlock, err := genesis.Block()
+	if err != nil {
+		return nil, err
+	}
+	chain.engine, err = genesis.Consensus()
+	if err != nil {
+		return nil, err
+	}
+	genesisHash := hex.EncodeToString(types.HashBlock(genesisBlock))
+
+	tip, err := bs.Tip()
+	if errors.Is(err, ErrNoTip) {
+		chain.index[genesisHash] = chain.newBlockNode(genesisBlock.Header, nil)
+		chain.finalized = chain.index[genesisHash]
+		return chain, chain.addBlock(genesisBlock)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chain.loadHeaders(tip); err != nil {
+		return nil, err
+	}
+	if hash := hex.EncodeToString(types.HashHeader(chain.genesisHeader())); hash != genesisHash {
+		return nil, fmt.Errorf("stored chain starts at genesis %s, expected %s (chain %s)", hash, genesisHash, genesis.ChainID)
+	}
+	chain.loadFinalized()
+
+	return chain, nil
+}
+
+func (c *Chain) Genesis() *Genesis {
+	return c.genesis
+}
+
+func (c *Chain) Consensus() consensus.Engine {
+	return c.engine
+}
+
+// GetHeader returns the header of any block we know, main chain or not.
+func (c *Chain) GetHeader(hash []byte) (*proto.Header, error) {
+	b, err := c.blockStore.Get(hex.EncodeToString(hash))
+	if err != nil {
+		return nil, err
+	}
+	return b.Header, nil
+}
+
+// loadHeaders walks back from the tip to genesis rebuilding the header list
+// and the block index of the main chain.
+func (c *Chain) loadHeaders(tip string) error {
+	headers := []*proto.Header{}
+
+	for hash := tip; ; {
+		b, err := c.blockStore.Get(hash)
+		if err != nil {
+			return err
+		}
+		headers = append([]*proto.Header{b.Header}, headers...)
+
+		if b.Header.Height == 0 {
+			break
+		}
+		hash = hex.EncodeToString(b.Header.PrevHash)
+	}
+
+	var parent *blockNode
+	for _, header := range headers {
+		node := c.newBlockNode(header, parent)
+		c.index[node.hash] = node
+		c.headers.Add(header)
+		parent = node
+	}
+
+	return nil
+}
+
+// loadFinalized finds the highest main chain block with a stored commit
+// certificate.
+func (c *Chain) loadFinalized() {
+	c.finalized = c.index[hex.EncodeToString(types.HashHeader(c.genesisHeader()))]
+	if _, ok := c.engine.(*consensus.BFT); !ok {
+		return
+	}
+
+	for height := c.Height(); height > 0; height-- {
+		hash := c.hashAt(height)
+		if _, err := c.blockStore.GetCommit(hash); err == nil {
+			c.finalized = c.index[hash]
+			return
+		}
+	}
+}
+
+// Observe registers o to be told about every block connected to or
+// disconnected from the main chain from now on.
+func (c *Chain) Observe(o BlockObserver) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.observers = append(c.observers, o)
 }
 
 func (c *Chain) Height() int {
 	return c.headers.Height()
 }
 
+// Tip returns the header of the last block of the main chain.
+func (c *Chain) Tip() *proto.Header {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.headers.Last()
+}
+
+// HeaderAt returns the header of the main chain block at the given height.
+func (c *Chain) HeaderAt(height int) (*proto.Header, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.headers.Get(height)
+}
+
+// FinalizedHeader returns the header of the last block that can't be
+// reverted anymore.
+func (c *Chain) FinalizedHeader() *proto.Header {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	h, err := c.headers.Get(c.finalized.height)
+	if err != nil {
+		// the finalized block never leaves the main chain
+		panic(err)
+	}
+	return h
+}
+
+// FinalizedHeight returns the height of the last block that can't be
+// reverted anymore. Only engines with finality move it past genesis.
+func (c *Chain) FinalizedHeight() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.finalized.height
+}
+
+// Finalize marks the block of cert and everything before it as final and
+// stores the certificate next to the block. A final block on a side branch
+// makes the chain reorganize onto it.
+func (c *Chain) Finalize(cert *proto.CommitCertificate) error {
+	bft, ok := c.engine.(*consensus.BFT)
+	if !ok {
+		return fmt.Errorf("consensus engine has no finality")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hash := hex.EncodeToString(cert.BlockHash)
+	node, ok := c.index[hash]
+	if !ok {
+		return fmt.Errorf("unknown block [%s]", hash)
+	}
+	if node.height <= c.finalized.height {
+		return fmt.Errorf("block [%s] at height %d is not above the finalized height %d", hash, node.height, c.finalized.height)
+	}
+	if !c.descendsFromFinalized(node) {
+		return fmt.Errorf("block [%s] forks off below the finalized height %d", hash, c.finalized.height)
+	}
+
+	b, err := c.blockStore.Get(hash)
+	if err != nil {
+		return err
+	}
+	if err := bft.VerifyCommit(b.Header, cert); err != nil {
+		return err
+	}
+	if !c.onMainChain(node) {
+		if err := c.reorganize(node); err != nil {
+			return err
+		}
+	}
+	if err := c.blockStore.PutCommit(cert); err != nil {
+		return err
+	}
+	c.finalized = node
+
+	return nil
+}
+
+// GetCommit returns the commit certificate of a final block.
+func (c *Chain) GetCommit(hash []byte) (*proto.CommitCertificate, error) {
+	return c.blockStore.GetCommit(hex.EncodeToString(hash))
+}
+
+func (c *Chain) descendsFromFinalized(node *blockNode) bool {
+	for node.height > c.finalized.height {
+		node = node.parent
+	}
+	return node.hash == c.finalized.hash
+}
+
+// AddBlock adds the block to the block tree. A block extending the tip is
+// appended to the main chain, a block on a side branch is kept around and
+// makes the chain reorganize onto that branch once it becomes the longest.
 func (c *Chain) AddBlock(b *proto.Block) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hash := hex.EncodeToString(types.HashBlock(b))
+	if _, ok := c.index[hash]; ok {
+		return fmt.Errorf("block [%s] already known", hash)
+	}
+
 	if err := c.ValidateBlock(b); err != nil {
 		return err
 	}
-	// add the header to the list of headers
-	return c.addBlock(b)
+
+	parent := c.index[hex.EncodeToString(b.Header.PrevHash)]
+	node := c.newBlockNode(b.Header, parent)
+
+	if parent.hash == c.tipHash() {
+		c.index[hash] = node
+		// add the header to the list of headers
+		return c.addBlock(b)
+	}
+
+	if err := c.blockStore.Put(b); err != nil {
+		return err
+	}
+	c.index[hash] = node
+
+	tip := consensus.Branch{Header: c.headers.Last(), Work: c.index[c.tipHash()].work}
+	if !c.engine.ForkChoice(tip, consensus.Branch{Header: b.Header, Work: node.work}) {
+		return nil
+	}
+	return c.reorganize(node)
 }
 
-func (c *Chain) addBlock(b *proto.Block) error {
-	c.headers.Add(b.Header)
+// reorganize switches the main chain over to the branch ending in newTip.
+// Blocks above the fork point are disconnected and the UTXO changes they
+// made are undone before the new branch gets connected. If the new branch
+// turns out to be invalid the old one is restored.
+func (c *Chain) reorganize(newTip *blockNode) error {
+	attach := []*blockNode{}
+	fork := newTip
+	for !c.onMainChain(fork) {
+		attach = append([]*blockNode{fork}, attach...)
+		fork = fork.parent
+	}
 
-	for _, tx := range b.Transactions {
-		fmt.Println("New TX: ", hex.EncodeToString(types.HashTransaction(tx)))
-		if err := c.txStore.Put(tx); err != nil {
+	detached := []*proto.Block{}
+	for height := c.Height(); height > fork.height; height-- {
+		b, err := c.getBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := c.disconnectBlock(b); err != nil {
+			return err
+		}
+		detached = append(detached, b)
+	}
+
+	attached := []*proto.Block{}
+	for _, node := range attach {
+		b, err := c.blockStore.Get(node.hash)
+		if err != nil {
+			return err
+		}
+
+		if err := c.validateTransactions(b); err != nil {
+			for i := len(attached) - 1; i >= 0; i-- {
+				if err := c.disconnectBlock(attached[i]); err != nil {
+					return err
+				}
+			}
+			for i := len(detached) - 1; i >= 0; i-- {
+				if err := c.addBlock(detached[i]); err != nil {
+					return err
+				}
+			}
+			// forget the invalid block so the branch can't win again
+			delete(c.index, node.hash)
+
+			return fmt.Errorf("reorg to block [%s] failed: %s", newTip.hash, err)
+		}
+
+		if err := c.addBlock(b); err != nil {
 			return err
 		}
+		attached = append(attached, b)
+	}
+
+	return nil
+}
+
+func (c *Chain) tipHash() string {
+	return hex.EncodeToString(types.HashHeader(c.headers.Last()))
+}
+
+func (c *Chain) genesisHeader() *proto.Header {
+	h, err := c.headers.Get(0)
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// hashAt returns the hash of the main chain block at height, empty when the
+// chain isn't that high.
+func (c *Chain) hashAt(height int) string {
+	h, err := c.headers.Get(height)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(types.HashHeader(h))
+}
+
+func (c *Chain) onMainChain(node *blockNode) bool {
+	return c.hashAt(node.height) == node.hash
+}
+
+// disconnectBlock removes the tip block from the main chain, deleting its
+// transactions and the outputs they created and making the ones they spent
+// available again.
+func (c *Chain) disconnectBlock(b *proto.Block) error {
+	u := newStoreUpdate()
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		hash := hex.EncodeToString(types.HashTransaction(tx))
+		u.deleted = append(u.deleted, hash)
+
+		for it := range tx.Outputs {
+			u.utxos[fmt.Sprintf("%s_%d", hash, it)] = nil
+		}
+
+		for _, input := range tx.Inputs {
+			utxo, err := u.utxo(c.utxoStore, outpointKey(input))
+			if err != nil {
+				return err
+			}
+			utxo.Spent = false
+			u.utxos[outpointKey(input)] = utxo
+		}
+	}
+	u.tip = hex.EncodeToString(b.Header.PrevHash)
+	if err := c.commit(u); err != nil {
+		return err
+	}
+	c.headers.Truncate(int(b.Header.Height) - 1)
+
+	for _, o := range c.observers {
+		o.BlockDisconnected(c, b)
+	}
+	return nil
+}
+
+func (c *Chain) addBlock(b *proto.Block) error {
+	u := newStoreUpdate()
+	for _, tx := range b.Transactions {
+		fmt.Println("New TX: ", hex.EncodeToString(types.HashTransaction(tx)))
+		u.txx = append(u.txx, tx)
 
 		hash := hex.EncodeToString(types.HashTransaction(tx))
 
 		for it, output := range tx.Outputs {
-			utxo := &UTXO{
+			u.utxos[fmt.Sprintf("%s_%d", hash, it)] = &UTXO{
 				Hash:     hash,
 				OutIndex: it,
 				Amount:   output.Amount,
+				Address:  hex.EncodeToString(output.Address),
 				Spent:    false,
-			}
-			if err := c.utxoStore.Put(utxo); err != nil {
-				return err
+				Height:   int(b.Header.Height),
 			}
 		}
 
 		for _, input := range tx.Inputs {
-			key := fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.GetPrevOutIndex())
-			utxo, err := c.utxoStore.Get(key)
+			utxo, err := u.utxo(c.utxoStore, outpointKey(input))
 			if err != nil {
 				return err
 			}
 			utxo.Spent = true
-			if err := c.utxoStore.Put(utxo); err != nil {
-				return err
-			}
+			u.utxos[outpointKey(input)] = utxo
 		}
 	}
-	return c.blockStore.Put(b)
+	u.block = b
+	u.tip = hex.EncodeToString(types.HashBlock(b))
+	if err := c.commit(u); err != nil {
+		return err
+	}
+	c.headers.Add(b.Header)
+
+	for _, o := range c.observers {
+		o.BlockConnected(c, b)
+	}
+	return nil
+}
+
+// commit applies the store writes of connecting or disconnecting a block,
+// in a single transaction when the stores share a bolt database.
+func (c *Chain) commit(u *storeUpdate) error {
+	if db := sharedBoltDB(c.blockStore, c.txStore, c.utxoStore); db != nil {
+		return commitUpdate(db, u)
+	}
+	return applyUpdate(c.blockStore, c.txStore, c.utxoStore, u)
 }
 
 func (c *Chain) GetBlockByHeight(height int) (*proto.Block, error) {
-	if c.Height() < height {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.getBlockByHeight(height)
+}
+
+func (c *Chain) getBlockByHeight(height int) (*proto.Block, error) {
+	header, err := c.headers.Get(height)
+	if err != nil {
 		return nil, fmt.Errorf("given height [%d] too high - height [%d]", height, c.Height())
 	}
-
-	header := c.headers.Get(height)
-	hash := types.HashHeader(header)
-	return c.GetBlockByHash(hash)
+	return c.GetBlockByHash(types.HashHeader(header))
 }
 
 func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
@@ -131,91 +589,413 @@ func (c *Chain) GetBlockByHash(hash []byte) (*proto.Block, error) {
 	return c.blockStore.Get(hashHex)
 }
 
+func (c *Chain) GetTransaction(hash []byte) (*proto.Transaction, error) {
+	return c.txStore.Get(hex.EncodeToString(hash))
+}
+
+// HasBlock reports whether the block is part of the block tree. Side branch
+// blocks stored before a restart are not, peers have to send them again.
+func (c *Chain) HasBlock(hash []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.index[hex.EncodeToString(hash)]
+	return ok
+}
+
+// Locator returns the hashes of main chain blocks a peer can use to find
+// where our chain forks from theirs. It starts at the tip, gets sparser the
+// further back it goes and always ends with the genesis block.
+func (c *Chain) Locator() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	locator := [][]byte{}
+	step := 1
+
+	for height := c.Height(); height > 0; height -= step {
+		h, err := c.headers.Get(height)
+		if err != nil {
+			break
+		}
+		locator = append(locator, types.HashHeader(h))
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	return append(locator, types.HashHeader(c.genesisHeader()))
+}
+
+// FindFork returns the height of the first locator hash that is part of our
+// main chain, or 0 when none is.
+func (c *Chain) FindFork(locator [][]byte) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, hash := range locator {
+		b, err := c.GetBlockByHash(hash)
+		if err != nil {
+			continue
+		}
+
+		if height := int(b.Header.Height); c.hashAt(height) == hex.EncodeToString(hash) {
+			return height
+		}
+	}
+
+	return 0
+}
+
+// ValidateBlock checks the block signature and that it links to a block we
+// know about. The transactions are only checked when the block extends the
+// tip, blocks on a side branch get them checked once we reorganize onto them.
 func (c *Chain) ValidateBlock(b *proto.Block) error {
-	/// validate the signature of the block
-	if !types.VerifyBlock(b) {
-		return fmt.Errorf("invalid block signature")
+	if b.Header.ChainID != c.genesis.ChainID {
+		return fmt.Errorf("block of chain %q, expected %q", b.Header.ChainID, c.genesis.ChainID)
+	}
+	// validate if the prevHash is the hash of a block we already have
+	parent, ok := c.index[hex.EncodeToString(b.Header.PrevHash)]
+	if !ok {
+		return fmt.Errorf("unknown previous block hash [%s]", hex.EncodeToString(b.Header.PrevHash))
+	}
+	if !c.descendsFromFinalized(parent) {
+		return fmt.Errorf("block forks off below the finalized height %d", c.finalized.height)
+	}
+	if int(b.Header.Height) != parent.height+1 {
+		return fmt.Errorf("invalid block height (%d) expected (%d)", b.Header.Height, parent.height+1)
 	}
-	// validate if the prevHash is the actually hash of the current block
-	currentBlock, err := c.GetBlockByHeight((c.Height()))
+	parentBlock, err := c.blockStore.Get(parent.hash)
 	if err != nil {
 		return err
 	}
-	hash := types.HashBlock(currentBlock)
-	if !bytes.Equal(hash, b.Header.PrevHash) {
-		return fmt.Errorf("invalid previous block hash")
+	if err := c.engine.VerifyHeader(c, parentBlock.Header, b, time.Now()); err != nil {
+		return err
 	}
 
-	for _, tx := range b.Transactions {
+	if parent.hash != c.tipHash() {
+		return nil
+	}
+	return c.validateTransactions(b)
+}
 
-		if err := c.ValidateTransaction(tx); err != nil {
-			return err
+// validateTransactions checks the transactions of a block extending the tip,
+// the coinbase first and no other one, none of them spending an output
+// another one already spends. Transactions may spend the outputs of the ones
+// before them in the block.
+func (c *Chain) validateTransactions(b *proto.Block) error {
+	if len(b.Transactions) == 0 || !types.IsCoinbase(b.Transactions[0]) {
+		return fmt.Errorf("block doesn't start with a coinbase transaction")
+	}
+
+	view := c.newUTXOView(b.Header, nil)
+	fees := int64(0)
+	for i, tx := range b.Transactions[1:] {
+		fee, err := view.add(tx)
+		if err != nil {
+			return fmt.Errorf("transaction %d of the block: %w", i+1, err)
 		}
+		if fees, err = types.AddAmount(fees, fee); err != nil {
+			return fmt.Errorf("block fees: %w", err)
+		}
+	}
+
+	return c.validateCoinbase(b.Transactions[0], int(b.Header.Height), fees)
+}
+
+// validateCoinbase checks that the coinbase of the block at height pays out
+// exactly the subsidy plus the fees, nothing gets burned.
+func (c *Chain) validateCoinbase(tx *proto.Transaction, height int, fees int64) error {
+	if tx.ChainID != c.genesis.ChainID {
+		return fmt.Errorf("coinbase of chain %q, expected %q", tx.ChainID, c.genesis.ChainID)
+	}
+	if int(tx.Height) != height {
+		return fmt.Errorf("coinbase of height %d in block at height %d", tx.Height, height)
+	}
+
+	paid, err := sumOutputs(tx)
+	if err != nil {
+		return fmt.Errorf("coinbase: %w", err)
+	}
+	reward, err := types.AddAmount(c.genesis.Subsidy, fees)
+	if err != nil {
+		return fmt.Errorf("coinbase: %w", err)
+	}
+	if paid != reward {
+		return fmt.Errorf("coinbase pays %d, expected subsidy %d plus fees %d", paid, c.genesis.Subsidy, fees)
 	}
 	return nil
 }
 
 func (c *Chain) ValidateTransaction(tx *proto.Transaction) error {
-	// verify the signature
-	if !types.VerifyTransaction(tx) {
-		return fmt.Errorf("invalid tx signature")
+	_, err := c.TransactionFee(tx)
+	return err
+}
+
+// TransactionFee validates tx as part of the block following the tip and
+// returns the fee it pays, what is left of its inputs after paying its
+// outputs. Every input has to spend a distinct unspent output owned by its
+// signer, every output has to pay a positive amount to a well formed address
+// and the lock times of tx have to be over.
+func (c *Chain) TransactionFee(tx *proto.Transaction) (int64, error) {
+	return c.newUTXOView(c.nextHeader(), nil).fee(tx)
+}
+
+// MempoolTransactionFee is TransactionFee for a transaction joining the
+// pool, its inputs may spend the outputs of pool transactions as well. It
+// doesn't check for conflicts with the pool, the pool does.
+func (c *Chain) MempoolTransactionFee(tx *proto.Transaction, pool *Mempool) (int64, error) {
+	return c.newUTXOView(c.nextHeader(), pool).fee(tx)
+}
+
+// nextHeader stands in for the header of the block following the tip, the
+// one a transaction validated now would make it into.
+func (c *Chain) nextHeader() *proto.Header {
+	return &proto.Header{
+		Height:    int32(c.Height() + 1),
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+// utxoView is the UTXO set of the tip plus the outputs of the transactions
+// added to it, the way the transactions of the block with the given header
+// see it. It falls back on the outputs of the pool transactions, if it has a
+// pool, which count as confirmed by that block. Outputs of main chain blocks
+// at or above the height of the header are left out, the block builds on a
+// block below them.
+type utxoView struct {
+	chain   *Chain
+	header  *proto.Header
+	pool    *Mempool
+	outputs map[string]*UTXO
+	spent   map[string]bool
+}
+
+func (c *Chain) newUTXOView(header *proto.Header, pool *Mempool) *utxoView {
+	return &utxoView{
+		chain:   c,
+		header:  header,
+		pool:    pool,
+		outputs: make(map[string]*UTXO),
+		spent:   make(map[string]bool),
+	}
+}
+
+func (v *utxoView) get(key string) (*UTXO, error) {
+	if utxo, ok := v.outputs[key]; ok {
+		return utxo, nil
+	}
+	utxo, err := v.chain.utxoStore.Get(key)
+	if err == nil && utxo.Height >= int(v.header.Height) {
+		utxo, err = nil, fmt.Errorf("output %s confirmed at height %d, not below %d", key, utxo.Height, v.header.Height)
+	}
+	if err != nil && v.pool != nil {
+		if utxo, err = v.pool.Output(key); err == nil {
+			utxo.Height = int(v.header.Height)
+		}
+	}
+	return utxo, err
+}
+
+// confirmedAt returns the unix time in nanoseconds of the block confirming
+// utxo, the block of the view for the outputs it confirms itself.
+func (v *utxoView) confirmedAt(utxo *UTXO) int64 {
+	if utxo.Height < int(v.header.Height) {
+		if h, err := v.chain.headers.Get(utxo.Height); err == nil {
+			return h.Timestamp
+		}
+	}
+	return v.header.Timestamp
+}
+
+// add validates tx on top of the view and adds its outputs to it. It fails
+// when tx spends an output a transaction added before spends.
+func (v *utxoView) add(tx *proto.Transaction) (int64, error) {
+	fee, err := v.fee(tx)
+	if err != nil {
+		return 0, err
+	}
+	return fee, v.apply(tx)
+}
+
+// apply adds the outputs of tx, validated with fee, to the view.
+func (v *utxoView) apply(tx *proto.Transaction) error {
+	if err := claimOutpoints(v.spent, tx); err != nil {
+		return err
 	}
-	// check if all the inputs are unspent
 
-	nInputs := len(tx.Inputs)
 	hash := hex.EncodeToString(types.HashTransaction(tx))
-	sumInputs := 0
+	for i, output := range tx.Outputs {
+		v.outputs[fmt.Sprintf("%s_%d", hash, i)] = &UTXO{
+			Hash:     hash,
+			OutIndex: i,
+			Amount:   output.Amount,
+			Address:  hex.EncodeToString(output.Address),
+			Height:   int(v.header.Height),
+		}
+	}
+	return nil
+}
 
-	for i := 0; i < nInputs; i++ {
-		prevHash := hex.EncodeToString(tx.Inputs[i].PrevTxHash)
-		key := fmt.Sprintf("%s_%d", prevHash, i)
-		utxo, err := c.utxoStore.Get(key)
-		sumInputs += int(utxo.Amount)
-		if err != nil {
-			return err
+func (v *utxoView) fee(tx *proto.Transaction) (int64, error) {
+	if tx.ChainID != v.chain.genesis.ChainID {
+		return 0, fmt.Errorf("transaction of chain %q, expected %q", tx.ChainID, v.chain.genesis.ChainID)
+	}
+	if types.IsCoinbase(tx) {
+		return 0, fmt.Errorf("coinbase transaction outside of the start of a block")
+	}
+	if err := v.checkLockTime(tx); err != nil {
+		return 0, err
+	}
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	seen := make(map[string]bool)
+	sumInputs := int64(0)
+	amounts := make([]int64, len(tx.Inputs))
+
+	for i, input := range tx.Inputs {
+		key := outpointKey(input)
+		if seen[key] {
+			return 0, fmt.Errorf("input %d of the tx %s spends output %s twice", i, hash, key)
 		}
+		seen[key] = true
 
+		utxo, err := v.get(key)
+		if err != nil {
+			return 0, fmt.Errorf("input %d of the tx %s spends an %w %s", i, hash, ErrUnknownOutput, key)
+		}
 		if utxo.Spent {
-			return fmt.Errorf("input %d of the tx %s is already spent", i, hash)
+			return 0, fmt.Errorf("input %d of the tx %s spends an %w %s", i, hash, ErrOutputSpent, key)
+		}
+		if !ownsUTXO(input.PublicKey, utxo) {
+			return 0, fmt.Errorf("input %d of the tx %s is not signed by the owner of the output", i, hash)
+		}
+		if err := v.checkSequence(input, utxo); err != nil {
+			return 0, fmt.Errorf("input %d of the tx %s: %w", i, hash, err)
 		}
 
+		amounts[i] = utxo.Amount
+		if sumInputs, err = types.AddAmount(sumInputs, utxo.Amount); err != nil {
+			return 0, fmt.Errorf("inputs of the tx %s: %w", hash, err)
+		}
 	}
 
-	sumOutputs := 0
-
-	for _, output := range tx.Outputs {
-		sumOutputs += int(output.Amount)
+	// verify the signatures against the amounts being spent
+	if !types.VerifyTransaction(tx, amounts) {
+		return 0, fmt.Errorf("invalid tx signature")
 	}
 
+	sumOutputs, err := sumOutputs(tx)
+	if err != nil {
+		return 0, fmt.Errorf("tx %s: %w", hash, err)
+	}
 	if sumInputs < sumOutputs {
-		return fmt.Errorf("insufficient balance got (%d) spending (%d)", sumInputs, sumOutputs)
+		return 0, fmt.Errorf("insufficient balance got (%d) spending (%d)", sumInputs, sumOutputs)
+	}
+
+	return sumInputs - sumOutputs, nil
+}
+
+// checkLockTime fails when the block of the view comes before the lock time
+// of tx, a height or a unix time in seconds.
+func (v *utxoView) checkLockTime(tx *proto.Transaction) error {
+	switch {
+	case tx.LockTime <= 0:
+		return nil
+	case tx.LockTime < types.LockTimeThreshold:
+		if int64(v.header.Height) < tx.LockTime {
+			return fmt.Errorf("%w until height %d, block at height %d", ErrTimeLocked, tx.LockTime, v.header.Height)
+		}
+	default:
+		if now := time.Unix(0, v.header.Timestamp).Unix(); now < tx.LockTime {
+			return fmt.Errorf("%w until %s, block at %s", ErrTimeLocked, time.Unix(tx.LockTime, 0).UTC(), time.Unix(now, 0).UTC())
+		}
+	}
+	return nil
+}
+
+// checkSequence fails when the block of the view comes too soon after the
+// one confirming the output input spends for its relative lock.
+func (v *utxoView) checkSequence(input *proto.TxInput, utxo *UTXO) error {
+	switch {
+	case input.Sequence == 0:
+		return nil
+	case input.Sequence&types.SequenceTimeFlag == 0:
+		if age := int(v.header.Height) - utxo.Height; age < int(input.Sequence) {
+			return fmt.Errorf("%w for %d blocks after the output, %d passed", ErrTimeLocked, input.Sequence, age)
+		}
+	default:
+		lock := time.Duration(input.Sequence&^types.SequenceTimeFlag) * time.Second
+		if age := time.Duration(v.header.Timestamp - v.confirmedAt(utxo)); age < lock {
+			return fmt.Errorf("%w for %s after the output, %s passed", ErrTimeLocked, lock, age)
+		}
 	}
 	return nil
+}
+
+// sumOutputs adds up what tx pays, rejecting outputs that don't pay a
+// positive amount to a valid address.
+func sumOutputs(tx *proto.Transaction) (int64, error) {
+	sum := int64(0)
+	for i, output := range tx.Outputs {
+		if output.Amount <= 0 {
+			return 0, fmt.Errorf("output %d pays a non positive amount (%d)", i, output.Amount)
+		}
+		if len(output.Address) != crypto.AddressLen {
+			return 0, fmt.Errorf("output %d has an invalid address length (%d)", i, len(output.Address))
+		}
+
+		var err error
+		if sum, err = types.AddAmount(sum, output.Amount); err != nil {
+			return 0, fmt.Errorf("outputs: %w", err)
+		}
+	}
+	return sum, nil
+}
 
+// claimOutpoints marks the outputs spent by tx in spent, unless one of them
+// already is.
+func claimOutpoints(spent map[string]bool, tx *proto.Transaction) error {
+	for _, input := range tx.Inputs {
+		if key := outpointKey(input); spent[key] {
+			return fmt.Errorf("output %s is already spent in the block", key)
+		}
+	}
+	for _, input := range tx.Inputs {
+		spent[outpointKey(input)] = true
+	}
+	return nil
 }
 
-func CreateGenesisBlock() *proto.Block {
-	privKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
+// outpointKey is the key of the output input spends in the UTXO store.
+func outpointKey(input *proto.TxInput) string {
+	return fmt.Sprintf("%s_%d", hex.EncodeToString(input.PrevTxHash), input.PrevOutIndex)
+}
 
-	block := &proto.Block{
-		Header: &proto.Header{
-			Version: 1,
-		},
+func ownsUTXO(pubKey []byte, utxo *UTXO) bool {
+	if len(pubKey) != crypto.PubKeyLen {
+		return false
 	}
+	return crypto.PublicKeyFromBytes(pubKey).Address().String() == utxo.Address
+}
+
+// ListUnspent returns the outputs the given address can spend.
+func (c *Chain) ListUnspent(addr crypto.Address) ([]*UTXO, error) {
+	return c.utxoStore.ListUnspent(addr.String())
+}
 
-	tx := &proto.Transaction{
-		Version: 1,
-		Inputs:  []*proto.TxInput{},
-		Outputs: []*proto.TxOutput{
-			{
-				Amount:  1000,
-				Address: privKey.Public().Address().Bytes(),
-			},
-		}}
+func (c *Chain) GetBalance(addr crypto.Address) (int64, error) {
+	utxos, err := c.ListUnspent(addr)
+	if err != nil {
+		return 0, err
+	}
 
-	block.Transactions = append(block.Transactions, tx)
-	types.SignBlock(privKey, block)
+	balance := int64(0)
+	for _, utxo := range utxos {
+		if balance, err = types.AddAmount(balance, utxo.Amount); err != nil {
+			return 0, fmt.Errorf("balance of %s: %w", addr, err)
+		}
+	}
 
-	types.SignBlock(privKey, block)
-	return block
+	return balance, nil
 }
@@ -1,10 +1,16 @@
 package node
 
 import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/consensus"
 	"github.com/wvalencia19/blocker/crypto"
 	"github.com/wvalencia19/blocker/proto"
 	"github.com/wvalencia19/blocker/types"
@@ -12,13 +18,7 @@ import (
 )
 
 func RandomBlock(t *testing.T, chain *Chain) *proto.Block {
-	privKey := crypto.GeneratePrivatekey()
-	b := util.RandomBlock()
-	prevBlock, err := chain.GetBlockByHeight(chain.Height())
-	require.Nil(t, err)
-	b.Header.PrevHash = types.HashBlock(prevBlock)
-	types.SignBlock(privKey, b)
-	return b
+	return childBlock(t, mustTip(t, chain))
 }
 
 func TestNewChain(t *testing.T) {
@@ -38,6 +38,23 @@ func TestChainHeight(t *testing.T) {
 	}
 
 }
+func TestHeaderListGet(t *testing.T) {
+	list := NewHeaderList()
+	list.Add(&proto.Header{Height: 0})
+	list.Add(&proto.Header{Height: 1})
+
+	h, err := list.Get(1)
+	require.Nil(t, err)
+	assert.Equal(t, int32(1), h.Height)
+	assert.Equal(t, h, list.Last())
+
+	list.Truncate(0)
+	_, err = list.Get(1)
+	assert.NotNil(t, err)
+	_, err = list.Get(-1)
+	assert.NotNil(t, err)
+}
+
 func TestAddBlock(t *testing.T) {
 	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
 	for i := 0; i < 100; i++ {
@@ -63,8 +80,9 @@ func TestAddBlockWithTx(t *testing.T) {
 	privKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
 	recipient := crypto.GeneratePrivatekey().Public().Address().Bytes()
 
-	prevTx, err := chain.txStore.Get("b78abe0c0dc56af50d070c97bffa92867fda1c26c47455d954533d9f3ce888b6")
-	assert.Nil(t, err)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	prevTx := genesis.Transactions[0]
 
 	inputs := []*proto.TxInput{
 		{
@@ -86,12 +104,12 @@ func TestAddBlockWithTx(t *testing.T) {
 
 	tx := &proto.Transaction{
 		Version: 1,
+		ChainID: DevChainID,
 		Inputs:  inputs,
 		Outputs: outputs,
 	}
 
-	sig := types.SignTransaction(privKey, tx)
-	tx.Inputs[0].Signature = sig.Bytes()
+	types.SignTransactionInput(privKey, tx, 0, 1000)
 
 	block.Transactions = append(block.Transactions, tx)
 	types.SignBlock(privKey, block)
@@ -105,8 +123,9 @@ func TestBlockWithTXInsufficientFunds(t *testing.T) {
 	privKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
 	recipient := crypto.GeneratePrivatekey().Public().Address().Bytes()
 
-	prevTx, err := chain.txStore.Get("b78abe0c0dc56af50d070c97bffa92867fda1c26c47455d954533d9f3ce888b6")
-	assert.Nil(t, err)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	prevTx := genesis.Transactions[0]
 
 	inputs := []*proto.TxInput{
 		{
@@ -124,14 +143,827 @@ func TestBlockWithTXInsufficientFunds(t *testing.T) {
 
 	tx := &proto.Transaction{
 		Version: 1,
+		ChainID: DevChainID,
 		Inputs:  inputs,
 		Outputs: outputs,
 	}
 
-	sig := types.SignTransaction(privKey, tx)
-	tx.Inputs[0].Signature = sig.Bytes()
+	types.SignTransactionInput(privKey, tx, 0, 1000)
 
 	block.Transactions = append(block.Transactions, tx)
 	types.SignBlock(privKey, block)
 	require.NotNil(t, chain.AddBlock(block))
 }
+
+// childBlock builds a block on top of parent signed by the development
+// network validator in the first slot after parent. The coinbase pays the
+// subsidy of the development network, the transactions must not pay fees.
+func childBlock(t *testing.T, parent *proto.Block, txx ...*proto.Transaction) *proto.Block {
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	g := DefaultGenesis()
+	g.ChainID = parent.Header.ChainID
+
+	b := util.RandomBlock()
+	b.Header.PrevHash = types.HashBlock(parent)
+	b.Header.Height = parent.Header.Height + 1
+	b.Header.ChainID = parent.Header.ChainID
+	b.Header.Timestamp = parent.Header.Timestamp + int64(defaultBlockTime)
+	coinbase := g.Coinbase(int(b.Header.Height), god.Public().Address(), 0)
+	b.Transactions = append([]*proto.Transaction{coinbase}, txx...)
+	types.SignBlock(god, b)
+	return b
+}
+
+func genesisSpend(t *testing.T, chain *Chain) *proto.Transaction {
+	privKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(genesis.Transactions[0]),
+				PrevOutIndex: 0,
+				PublicKey:    privKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  1000,
+				Address: crypto.GeneratePrivatekey().Public().Address().Bytes(),
+			},
+		},
+	}
+	types.SignTransactionInput(privKey, tx, 0, 1000)
+	return tx
+}
+
+func TestChainReorg(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	mempool := NewMempool(0, 0, 0)
+	chain.Observe(mempool)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	genesisKey := fmt.Sprintf("%s_0", hex.EncodeToString(types.HashTransaction(genesis.Transactions[0])))
+
+	tx := genesisSpend(t, chain)
+	a1 := childBlock(t, genesis, tx)
+	a2 := childBlock(t, a1)
+	require.Nil(t, chain.AddBlock(a1))
+	require.Nil(t, chain.AddBlock(a2))
+
+	utxo, err := chain.utxoStore.Get(genesisKey)
+	require.Nil(t, err)
+	assert.True(t, utxo.Spent)
+
+	// a side branch only becomes the main chain once it is longer
+	b1 := childBlock(t, genesis)
+	b2 := childBlock(t, b1)
+	require.Nil(t, chain.AddBlock(b1))
+	require.Nil(t, chain.AddBlock(b2))
+	assert.Equal(t, 2, chain.Height())
+	tip, err := chain.GetBlockByHeight(2)
+	require.Nil(t, err)
+	assert.Equal(t, a2, tip)
+
+	b3 := childBlock(t, b2)
+	require.Nil(t, chain.AddBlock(b3))
+	assert.Equal(t, 3, chain.Height())
+	for i, b := range []*proto.Block{b1, b2, b3} {
+		fetched, err := chain.GetBlockByHeight(i + 1)
+		require.Nil(t, err)
+		assert.Equal(t, b, fetched)
+	}
+
+	utxo, err = chain.utxoStore.Get(genesisKey)
+	require.Nil(t, err)
+	assert.False(t, utxo.Spent)
+	_, err = chain.utxoStore.Get(fmt.Sprintf("%s_0", hex.EncodeToString(types.HashTransaction(tx))))
+	assert.NotNil(t, err)
+	assert.True(t, mempool.Has(tx))
+	_, err = chain.GetTransaction(types.HashTransaction(tx))
+	assert.NotNil(t, err, "orphaned tx is no longer confirmed")
+
+	// the orphaned tx is valid again on the new main chain
+	require.Nil(t, chain.AddBlock(childBlock(t, b3, tx)))
+	assert.Equal(t, 4, chain.Height())
+	_, err = chain.GetTransaction(types.HashTransaction(tx))
+	assert.Nil(t, err)
+}
+
+func TestChainReorgInvalidBranch(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	a1 := childBlock(t, genesis)
+	require.Nil(t, chain.AddBlock(a1))
+
+	// spends an output that does not exist
+	invalidTx := genesisSpend(t, chain)
+	invalidTx.Inputs[0].PrevTxHash = util.RandomHash()
+	types.SignTransactionInput(crypto.NewPrivateKeyFromSeedStr(godSeed), invalidTx, 0, 1000)
+
+	b1 := childBlock(t, genesis, invalidTx)
+	b2 := childBlock(t, b1)
+	require.Nil(t, chain.AddBlock(b1))
+	require.NotNil(t, chain.AddBlock(b2))
+
+	assert.Equal(t, 1, chain.Height())
+	tip, err := chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Equal(t, a1, tip)
+}
+
+func TestChainRejectsOrphanAndDuplicate(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	b := RandomBlock(t, chain)
+	require.Nil(t, chain.AddBlock(b))
+	assert.NotNil(t, chain.AddBlock(b))
+
+	orphan := util.RandomBlock()
+	types.SignBlock(crypto.GeneratePrivatekey(), orphan)
+	assert.NotNil(t, chain.AddBlock(orphan))
+
+	wrongHeight := RandomBlock(t, chain)
+	wrongHeight.Header.Height = 5
+	types.SignBlock(crypto.GeneratePrivatekey(), wrongHeight)
+	assert.NotNil(t, chain.AddBlock(wrongHeight))
+}
+
+func TestChainFindFork(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	for i := 0; i < 30; i++ {
+		require.Nil(t, chain.AddBlock(RandomBlock(t, chain)))
+	}
+
+	locator := chain.Locator()
+	assert.Equal(t, 30, chain.FindFork(locator))
+
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(genesis), locator[len(locator)-1])
+
+	other := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	for i := 0; i < 5; i++ {
+		b := RandomBlock(t, other)
+		b.Header.Timestamp++
+		types.SignBlock(crypto.NewPrivateKeyFromSeedStr(godSeed), b)
+		require.Nil(t, other.AddBlock(b))
+	}
+	assert.Equal(t, 0, chain.FindFork(other.Locator()))
+}
+
+func TestAddBlockWithMultiInputTx(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	godKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	alice := crypto.GeneratePrivatekey()
+	bob := crypto.GeneratePrivatekey()
+
+	split := genesisSpend(t, chain)
+	split.Outputs = []*proto.TxOutput{
+		{Amount: 400, Address: alice.Public().Address().Bytes()},
+		{Amount: 600, Address: bob.Public().Address().Bytes()},
+	}
+	require.Nil(t, types.SignTransactionInputs(split, []*crypto.PrivateKey{godKey}, []int64{1000}))
+	require.Nil(t, chain.AddBlock(childBlock(t, mustTip(t, chain), split)))
+
+	splitHash := types.HashTransaction(split)
+	merge := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Inputs: []*proto.TxInput{
+			{PrevTxHash: splitHash, PrevOutIndex: 0},
+			{PrevTxHash: splitHash, PrevOutIndex: 1},
+		},
+		Outputs: []*proto.TxOutput{
+			{Amount: 1000, Address: alice.Public().Address().Bytes()},
+		},
+	}
+	require.Nil(t, types.SignTransactionInputs(merge, []*crypto.PrivateKey{alice, bob}, []int64{400, 600}))
+	require.Nil(t, chain.ValidateTransaction(merge))
+	require.Nil(t, chain.AddBlock(childBlock(t, mustTip(t, chain), merge)))
+	assert.Equal(t, 2, chain.Height())
+
+	// signing with the amounts swapped doesn't match what is being spent
+	swapped := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Inputs: []*proto.TxInput{
+			{PrevTxHash: types.HashTransaction(merge), PrevOutIndex: 0},
+		},
+		Outputs: []*proto.TxOutput{
+			{Amount: 10, Address: bob.Public().Address().Bytes()},
+		},
+	}
+	require.Nil(t, types.SignTransactionInputs(swapped, []*crypto.PrivateKey{alice}, []int64{10}))
+	assert.NotNil(t, chain.ValidateTransaction(swapped))
+}
+
+func mustTip(t *testing.T, chain *Chain) *proto.Block {
+	b, err := chain.GetBlockByHeight(chain.Height())
+	require.Nil(t, err)
+	return b
+}
+
+func TestChainListUnspent(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	godKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	godAddr := godKey.Public().Address()
+	alice := crypto.GeneratePrivatekey().Public().Address()
+
+	balance, err := chain.GetBalance(godAddr)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000), balance)
+
+	tx := genesisSpend(t, chain)
+	tx.Outputs = []*proto.TxOutput{
+		{Amount: 300, Address: alice.Bytes()},
+		{Amount: 700, Address: godAddr.Bytes()},
+	}
+	types.SignTransactionInput(godKey, tx, 0, 1000)
+	require.Nil(t, chain.AddBlock(childBlock(t, mustTip(t, chain), tx)))
+
+	// the change plus the block subsidy
+	balance, err = chain.GetBalance(godAddr)
+	require.Nil(t, err)
+	assert.Equal(t, int64(700+defaultSubsidy), balance)
+
+	utxos, err := chain.ListUnspent(alice)
+	require.Nil(t, err)
+	require.Len(t, utxos, 1)
+	assert.Equal(t, hex.EncodeToString(types.HashTransaction(tx)), utxos[0].Hash)
+	assert.Equal(t, 0, utxos[0].OutIndex)
+	assert.Equal(t, int64(300), utxos[0].Amount)
+}
+
+func TestChainBalanceOverflow(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	alice := crypto.GeneratePrivatekey().Public().Address()
+	for i := 0; i < 2; i++ {
+		require.Nil(t, chain.utxoStore.Put(&UTXO{Hash: "ff", OutIndex: i, Amount: math.MaxInt64, Address: alice.String()}))
+	}
+
+	_, err := chain.GetBalance(alice)
+	assert.ErrorContains(t, err, "overflow")
+}
+
+func TestSpendNotOwnedOutput(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	thief := crypto.GeneratePrivatekey()
+
+	tx := genesisSpend(t, chain)
+	tx.Inputs[0].PublicKey = thief.Public().Bytes()
+	types.SignTransactionInput(thief, tx, 0, 1000)
+
+	assert.NotNil(t, chain.ValidateTransaction(tx))
+}
+
+func TestRejectForeignChainID(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	tx := genesisSpend(t, chain)
+	tx.ChainID = "other-net"
+	types.SignTransactionInput(crypto.NewPrivateKeyFromSeedStr(godSeed), tx, 0, 1000)
+	assert.NotNil(t, chain.ValidateTransaction(tx))
+
+	b := childBlock(t, genesis)
+	b.Header.ChainID = "other-net"
+	types.SignBlock(crypto.GeneratePrivatekey(), b)
+	assert.NotNil(t, chain.AddBlock(b))
+	assert.Equal(t, 0, chain.Height())
+}
+
+func TestValidateBlockProposer(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+
+	b := RandomBlock(t, chain)
+	types.SignBlock(crypto.GeneratePrivatekey(), b)
+	assert.NotNil(t, chain.AddBlock(b))
+
+	// signed by the validator but before its slot started
+	b = RandomBlock(t, chain)
+	b.Header.Timestamp -= int64(time.Second)
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(godSeed), b)
+	assert.NotNil(t, chain.AddBlock(b))
+
+	// after a few missed slots
+	b = RandomBlock(t, chain)
+	b.Header.Timestamp += 3 * int64(defaultBlockTime)
+	types.SignBlock(crypto.NewPrivateKeyFromSeedStr(godSeed), b)
+	assert.Nil(t, chain.AddBlock(b))
+	assert.Equal(t, 1, chain.Height())
+}
+
+// minedBlock builds a block on parent at the given time with the target the
+// proof of work chain expects and mines it.
+func minedBlock(t *testing.T, chain *Chain, parent *proto.Block, timestamp time.Time) *proto.Block {
+	pow := chain.Consensus().(*consensus.PoW)
+	bits, err := pow.NextBits(chain, parent.Header)
+	require.Nil(t, err)
+
+	b := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Height:    parent.Header.Height + 1,
+			PrevHash:  types.HashBlock(parent),
+			Timestamp: timestamp.UnixNano(),
+			ChainID:   parent.Header.ChainID,
+			Bits:      bits,
+		},
+	}
+	pk := crypto.GeneratePrivatekey()
+	b.Transactions = []*proto.Transaction{chain.Genesis().Coinbase(int(b.Header.Height), pk.Public().Address(), 0)}
+	require.Nil(t, pow.Seal(context.Background(), pk, b))
+	return b
+}
+
+func TestChainHeaviestWork(t *testing.T) {
+	g := DefaultGenesis()
+	g.Engine = EnginePoW
+	g.Difficulty = 2
+	g.RetargetInterval = 2
+	g.BlockTime = Duration{time.Hour}
+	g.Validators = nil
+	chain, err := OpenChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore(), g)
+	require.Nil(t, err)
+	genesis := mustTip(t, chain)
+	start := g.Timestamp
+
+	// blocks on time keep the genesis target
+	a1 := minedBlock(t, chain, genesis, start.Add(time.Hour))
+	require.Nil(t, chain.AddBlock(a1))
+	a2 := minedBlock(t, chain, a1, start.Add(2*time.Hour))
+	require.Nil(t, chain.AddBlock(a2))
+	a3 := minedBlock(t, chain, a2, start.Add(3*time.Hour))
+	require.Nil(t, chain.AddBlock(a3))
+	assert.Equal(t, genesis.Header.Bits, a3.Header.Bits)
+
+	// a branch mined fast gets a four times harder block at height 2,
+	// outweighing the longer branch
+	b1 := minedBlock(t, chain, genesis, start.Add(time.Millisecond))
+	require.Nil(t, chain.AddBlock(b1))
+	b2 := minedBlock(t, chain, b1, start.Add(2*time.Millisecond))
+	assert.NotEqual(t, genesis.Header.Bits, b2.Header.Bits)
+	require.Nil(t, chain.AddBlock(b2))
+
+	assert.Equal(t, 2, chain.Height())
+	assert.Equal(t, types.HashBlock(b2), types.HashBlock(mustTip(t, chain)))
+}
+
+func commitFor(b *proto.Block, keys ...*crypto.PrivateKey) *proto.CommitCertificate {
+	cert := &proto.CommitCertificate{
+		Height:    b.Header.Height,
+		BlockHash: types.HashBlock(b),
+	}
+	for _, pk := range keys {
+		v := &proto.Vote{
+			Type:      proto.VoteType_PRECOMMIT,
+			Height:    b.Header.Height,
+			BlockHash: types.HashBlock(b),
+			ChainID:   b.Header.ChainID,
+		}
+		types.SignVote(pk, v)
+		cert.Precommits = append(cert.Precommits, v)
+	}
+	return cert
+}
+
+func TestChainFinalize(t *testing.T) {
+	g := DefaultGenesis()
+	g.Engine = EngineBFT
+	bs, txStore, utxoStore := NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore()
+	chain, err := OpenChain(bs, txStore, utxoStore, g)
+	require.Nil(t, err)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis := mustTip(t, chain)
+
+	b1 := childBlock(t, genesis)
+	require.Nil(t, chain.AddBlock(b1))
+	b2 := childBlock(t, b1)
+	require.Nil(t, chain.AddBlock(b2))
+	assert.Equal(t, 2, chain.Height())
+	assert.Equal(t, 0, chain.FinalizedHeight())
+
+	assert.NotNil(t, chain.Finalize(commitFor(b1, crypto.GeneratePrivatekey())))
+	require.Nil(t, chain.Finalize(commitFor(b1, god)))
+	assert.Equal(t, 1, chain.FinalizedHeight())
+	cert, err := chain.GetCommit(types.HashBlock(b1))
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(b1), cert.BlockHash)
+	assert.NotNil(t, chain.Finalize(commitFor(genesis, god)))
+
+	// nothing forking off below the final block is accepted anymore
+	fork := childBlock(t, genesis)
+	fork.Header.Timestamp++
+	types.SignBlock(god, fork)
+	assert.ErrorContains(t, chain.AddBlock(fork), "finalized")
+
+	reopened, err := OpenChain(bs, txStore, utxoStore, g)
+	require.Nil(t, err)
+	assert.Equal(t, 2, reopened.Height())
+	assert.Equal(t, 1, reopened.FinalizedHeight())
+}
+
+func TestChainFinalizeSideBranch(t *testing.T) {
+	g := DefaultGenesis()
+	g.Engine = EngineBFT
+	chain, err := OpenChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore(), g)
+	require.Nil(t, err)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis := mustTip(t, chain)
+
+	// a proposal of a later round replaces the one at the same height
+	b1 := childBlock(t, genesis)
+	require.Nil(t, chain.AddBlock(b1))
+	later := childBlock(t, genesis)
+	later.Header.Timestamp += int64(defaultBlockTime)
+	types.SignBlock(god, later)
+	require.Nil(t, chain.AddBlock(later))
+	assert.Equal(t, types.HashBlock(later), types.HashBlock(mustTip(t, chain)))
+
+	// yet the earlier one wins once it gets finalized
+	require.Nil(t, chain.Finalize(commitFor(b1, god)))
+	assert.Equal(t, types.HashBlock(b1), types.HashBlock(mustTip(t, chain)))
+	assert.Equal(t, 1, chain.FinalizedHeight())
+
+	// chains without finality can't finalize
+	poa := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	assert.NotNil(t, poa.Finalize(commitFor(mustTip(t, poa), god)))
+}
+
+func TestBlockCoinbase(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	tip := mustTip(t, chain)
+
+	tx := genesisSpend(t, chain)
+	tx.Outputs[0].Amount = 990
+	types.SignTransactionInput(god, tx, 0, 1000)
+	fee, err := chain.TransactionFee(tx)
+	require.Nil(t, err)
+	assert.Equal(t, int64(10), fee)
+
+	coinbase := chain.Genesis().Coinbase(1, god.Public().Address(), fee)
+	assert.NotNil(t, chain.ValidateTransaction(coinbase))
+
+	block := func(txx ...*proto.Transaction) *proto.Block {
+		b := childBlock(t, tip)
+		b.Transactions = txx
+		types.SignBlock(god, b)
+		return b
+	}
+	tests := map[string]*proto.Block{
+		"no coinbase":     block(tx),
+		"coinbase last":   block(tx, coinbase),
+		"two coinbases":   block(coinbase, chain.Genesis().Coinbase(1, god.Public().Address(), 0), tx),
+		"fees not paid":   block(chain.Genesis().Coinbase(1, god.Public().Address(), 0), tx),
+		"too much reward": block(chain.Genesis().Coinbase(1, god.Public().Address(), 11), tx),
+		"wrong height":    block(chain.Genesis().Coinbase(2, god.Public().Address(), 10), tx),
+		"foreign chain":   block(testGenesis(t, "other-net").Coinbase(1, god.Public().Address(), 10), tx),
+	}
+	for name, b := range tests {
+		assert.NotNil(t, chain.AddBlock(b), name)
+	}
+
+	require.Nil(t, chain.AddBlock(block(coinbase, tx)))
+	balance, err := chain.GetBalance(god.Public().Address())
+	require.Nil(t, err)
+	assert.Equal(t, defaultSubsidy+fee, balance)
+}
+
+// signedSpend builds a transaction of the development network spending the
+// given outputs of the split transaction, all of them owned by pk.
+func signedSpend(t *testing.T, pk *crypto.PrivateKey, prev *proto.Transaction, indexes []uint32, outputs ...*proto.TxOutput) *proto.Transaction {
+	tx := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Outputs: outputs,
+	}
+	keys := []*crypto.PrivateKey{}
+	amounts := []int64{}
+	for _, index := range indexes {
+		tx.Inputs = append(tx.Inputs, &proto.TxInput{
+			PrevTxHash:   types.HashTransaction(prev),
+			PrevOutIndex: index,
+		})
+		keys = append(keys, pk)
+		amounts = append(amounts, prev.Outputs[index].Amount)
+	}
+	require.Nil(t, types.SignTransactionInputs(tx, keys, amounts))
+	return tx
+}
+
+// splitChain is a development chain whose god key owns two outputs of 400
+// and 600 in a transaction of the block at height 1.
+func splitChain(t *testing.T) (*Chain, *proto.Transaction) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+
+	split := signedSpend(t, god, genesis.Transactions[0], []uint32{0},
+		&proto.TxOutput{Amount: 400, Address: god.Public().Address().Bytes()},
+		&proto.TxOutput{Amount: 600, Address: god.Public().Address().Bytes()},
+	)
+	require.Nil(t, chain.AddBlock(childBlock(t, genesis, split)))
+	return chain, split
+}
+
+func TestValidateTransaction(t *testing.T) {
+	chain, split := splitChain(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis, err := chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	to := crypto.GeneratePrivatekey().Public().Address().Bytes()
+	pay := func(amount int64) *proto.TxOutput {
+		return &proto.TxOutput{Amount: amount, Address: to}
+	}
+
+	tests := []struct {
+		name string
+		tx   func() *proto.Transaction
+		fee  int64
+		err  string
+	}{
+		{
+			name: "spends the second output",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{1}, pay(590)) },
+			fee:  10,
+		},
+		{
+			name: "spends both outputs",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{0, 1}, pay(1000)) },
+		},
+		{
+			name: "unknown output",
+			tx: func() *proto.Transaction {
+				tx := signedSpend(t, god, split, []uint32{0}, pay(400))
+				tx.Inputs[0].PrevTxHash = util.RandomHash()
+				return tx
+			},
+			err: "unknown output",
+		},
+		{
+			name: "output index out of range",
+			tx: func() *proto.Transaction {
+				tx := signedSpend(t, god, split, []uint32{0}, pay(400))
+				tx.Inputs[0].PrevOutIndex = 2
+				return tx
+			},
+			err: "unknown output",
+		},
+		{
+			name: "same output twice",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{1, 1}, pay(1200)) },
+			err:  "twice",
+		},
+		{
+			name: "already spent",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, genesis.Transactions[0], []uint32{0}, pay(1000)) },
+			err:  "already spent",
+		},
+		{
+			name: "not the owner",
+			tx: func() *proto.Transaction {
+				return signedSpend(t, crypto.GeneratePrivatekey(), split, []uint32{0}, pay(400))
+			},
+			err: "not signed by the owner",
+		},
+		{
+			name: "tampered after signing",
+			tx: func() *proto.Transaction {
+				tx := signedSpend(t, god, split, []uint32{0}, pay(400))
+				tx.Outputs[0].Amount = 300
+				return tx
+			},
+			err: "invalid tx signature",
+		},
+		{
+			name: "zero output",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{0}, pay(400), pay(0)) },
+			err:  "non positive amount",
+		},
+		{
+			name: "negative output",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{0}, pay(500), pay(-100)) },
+			err:  "non positive amount",
+		},
+		{
+			name: "outputs overflow",
+			tx: func() *proto.Transaction {
+				return signedSpend(t, god, split, []uint32{0}, pay(math.MaxInt64), pay(math.MaxInt64-398))
+			},
+			err: "overflow",
+		},
+		{
+			name: "invalid output address",
+			tx: func() *proto.Transaction {
+				return signedSpend(t, god, split, []uint32{0}, &proto.TxOutput{Amount: 400, Address: []byte{1, 2}})
+			},
+			err: "invalid address length",
+		},
+		{
+			name: "spends more than its inputs",
+			tx:   func() *proto.Transaction { return signedSpend(t, god, split, []uint32{0}, pay(401)) },
+			err:  "insufficient balance",
+		},
+		{
+			name: "foreign chain",
+			tx: func() *proto.Transaction {
+				tx := signedSpend(t, god, split, []uint32{0}, pay(400))
+				tx.ChainID = "other-net"
+				return tx
+			},
+			err: "chain",
+		},
+		{
+			name: "coinbase",
+			tx:   func() *proto.Transaction { return chain.Genesis().Coinbase(2, god.Public().Address(), 0) },
+			err:  "coinbase",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fee, err := chain.TransactionFee(tt.tx())
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.fee, fee)
+		})
+	}
+}
+
+func TestValidateBlockDoubleSpend(t *testing.T) {
+	chain, split := splitChain(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	tip := mustTip(t, chain)
+	alice := crypto.GeneratePrivatekey().Public().Address().Bytes()
+	bob := crypto.GeneratePrivatekey().Public().Address().Bytes()
+
+	toAlice := signedSpend(t, god, split, []uint32{0}, &proto.TxOutput{Amount: 400, Address: alice})
+	toBob := signedSpend(t, god, split, []uint32{0}, &proto.TxOutput{Amount: 400, Address: bob})
+	rest := signedSpend(t, god, split, []uint32{1}, &proto.TxOutput{Amount: 600, Address: bob})
+
+	assert.ErrorContains(t, chain.AddBlock(childBlock(t, tip, toAlice, toBob)), "already spent in the block")
+	assert.ErrorContains(t, chain.AddBlock(childBlock(t, tip, toAlice, rest, toAlice)), "already spent in the block")
+	assert.Equal(t, 1, chain.Height())
+
+	require.Nil(t, chain.AddBlock(childBlock(t, tip, toAlice, rest)))
+	assert.Equal(t, 2, chain.Height())
+}
+
+func TestValidateBlockChainedSpends(t *testing.T) {
+	chain, split := splitChain(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	tip := mustTip(t, chain)
+	alice := crypto.GeneratePrivatekey().Public().Address()
+
+	parent := signedSpend(t, god, split, []uint32{0}, &proto.TxOutput{Amount: 400, Address: god.Public().Address().Bytes()})
+	child := signedSpend(t, god, parent, []uint32{0}, &proto.TxOutput{Amount: 390, Address: alice.Bytes()})
+
+	// the child only sees the outputs of the transactions before it
+	_, err := chain.TransactionFee(child)
+	assert.ErrorIs(t, err, ErrUnknownOutput)
+	assert.ErrorIs(t, chain.AddBlock(childBlock(t, tip, child, parent)), ErrUnknownOutput)
+
+	pool := NewMempool(0, 0, 0)
+	require.True(t, pool.Add(parent, 0))
+	fee, err := chain.MempoolTransactionFee(child, pool)
+	require.Nil(t, err)
+	assert.Equal(t, int64(10), fee)
+
+	b := childBlock(t, tip, parent, child)
+	b.Transactions[0] = chain.Genesis().Coinbase(2, god.Public().Address(), 10)
+	types.SignBlock(god, b)
+	require.Nil(t, chain.AddBlock(b))
+	balance, err := chain.GetBalance(alice)
+	require.Nil(t, err)
+	assert.Equal(t, int64(390), balance)
+}
+
+func TestMempoolFollowsChain(t *testing.T) {
+	chain, split := splitChain(t)
+	pool := NewMempool(0, 0, 0)
+	chain.Observe(pool)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	tip := mustTip(t, chain)
+	pay := func(amount int64) *proto.TxOutput {
+		return &proto.TxOutput{Amount: amount, Address: god.Public().Address().Bytes()}
+	}
+
+	// branch a pays the first output through a parent and a child, spends
+	// the second one and the coinbase of its first block
+	parent := signedSpend(t, god, split, []uint32{0}, pay(400))
+	child := signedSpend(t, god, parent, []uint32{0}, pay(400))
+	second := signedSpend(t, god, split, []uint32{1}, pay(600))
+	a2 := childBlock(t, tip, parent)
+	reward := signedSpend(t, god, a2.Transactions[0], []uint32{0}, pay(defaultSubsidy))
+	a3 := childBlock(t, a2, child, second, reward)
+
+	pending := signedSpend(t, god, split, []uint32{1}, pay(300), pay(300))
+	require.True(t, pool.Add(parent, 0))
+	require.True(t, pool.Add(pending, 0))
+	require.Nil(t, chain.AddBlock(a2))
+	assert.False(t, pool.Has(parent), "included")
+	assert.True(t, pool.Has(pending))
+	require.Nil(t, chain.AddBlock(a3))
+	assert.False(t, pool.Has(pending), "double spent by the block")
+	assert.Equal(t, 0, pool.Len())
+
+	// branch b spends the second output another way and takes over
+	b2 := childBlock(t, tip, pending)
+	b3 := childBlock(t, b2)
+	b4 := childBlock(t, b3)
+	for _, b := range []*proto.Block{b2, b3, b4} {
+		require.Nil(t, chain.AddBlock(b))
+	}
+	assert.Equal(t, types.HashBlock(b4), types.HashBlock(mustTip(t, chain)))
+
+	assert.True(t, pool.Has(parent))
+	assert.True(t, pool.Has(child))
+	assert.False(t, pool.Has(second), "double spent by the new branch")
+	assert.False(t, pool.Has(reward), "spends a coinbase that is gone")
+	assert.Equal(t, hashes([]*proto.Transaction{parent, child}), hashes(pool.Select(maxBlockTxBytes)))
+}
+
+func TestTimeLocks(t *testing.T) {
+	chain, split := splitChain(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	pay := func(amount int64) *proto.TxOutput {
+		return &proto.TxOutput{Amount: amount, Address: god.Public().Address().Bytes()}
+	}
+	resign := func(tx *proto.Transaction, amount int64) *proto.Transaction {
+		require.Nil(t, types.SignTransactionInputs(tx, []*crypto.PrivateKey{god}, []int64{amount}))
+		return tx
+	}
+	spend := func(lockTime int64, sequence uint32) *proto.Transaction {
+		tx := signedSpend(t, god, split, []uint32{0}, pay(400))
+		tx.LockTime = lockTime
+		tx.Inputs[0].Sequence = sequence
+		return resign(tx, 400)
+	}
+
+	byHeight := spend(3, 0)
+	byAge := spend(0, 2)
+	byAgeTime := spend(0, types.SequenceTimeFlag|uint32(2*defaultBlockTime/time.Second))
+	for _, tx := range []*proto.Transaction{byHeight, byAge, spend(time.Now().Add(time.Hour).Unix(), 0)} {
+		_, err := chain.TransactionFee(tx)
+		assert.ErrorIs(t, err, ErrTimeLocked)
+	}
+	// the next block is due now, long after the split got confirmed
+	for _, tx := range []*proto.Transaction{byAgeTime, spend(time.Now().Add(-time.Hour).Unix(), 0)} {
+		_, err := chain.TransactionFee(tx)
+		assert.Nil(t, err)
+	}
+
+	// blocks check the locks against their own height and timestamp
+	tip := mustTip(t, chain)
+	for _, tx := range []*proto.Transaction{byHeight, byAge, byAgeTime} {
+		assert.ErrorIs(t, chain.ValidateBlock(childBlock(t, tip, tx)), ErrTimeLocked)
+	}
+	b2 := childBlock(t, tip)
+	require.Nil(t, chain.AddBlock(b2))
+	for _, tx := range []*proto.Transaction{byHeight, byAge, byAgeTime} {
+		assert.Nil(t, chain.ValidateBlock(childBlock(t, b2, tx)))
+	}
+
+	// pool transactions count as confirmed by the next block
+	pool := NewMempool(0, 0, 0)
+	parent := signedSpend(t, god, split, []uint32{1}, pay(600))
+	require.True(t, pool.Add(parent, 0))
+	child := signedSpend(t, god, parent, []uint32{0}, pay(600))
+	child.Inputs[0].Sequence = 1
+	_, err := chain.MempoolTransactionFee(resign(child, 600), pool)
+	assert.ErrorIs(t, err, ErrTimeLocked)
+}
+
+func TestUTXOViewBelowTip(t *testing.T) {
+	chain, split := splitChain(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	pay := func(amount int64) *proto.TxOutput {
+		return &proto.TxOutput{Amount: amount, Address: god.Public().Address().Bytes()}
+	}
+	parent := signedSpend(t, god, split, []uint32{0}, pay(400))
+	b2 := childBlock(t, mustTip(t, chain), parent)
+	require.Nil(t, chain.AddBlock(b2))
+
+	// a block building on the block at height 1 doesn't see what block 2
+	// confirmed, like a BFT proposal on the last final block
+	child := signedSpend(t, god, parent, []uint32{0}, pay(400))
+	reward := signedSpend(t, god, b2.Transactions[0], []uint32{0}, pay(defaultSubsidy))
+	for _, tx := range []*proto.Transaction{child, reward} {
+		_, err := chain.newUTXOView(&proto.Header{Height: 2}, nil).fee(tx)
+		assert.ErrorIs(t, err, ErrUnknownOutput)
+		_, err = chain.newUTXOView(&proto.Header{Height: 3}, nil).fee(tx)
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,236 @@
+package node
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envPrefix            = "BLOCKER_"
+	defaultMempoolExpiry = 72 * time.Hour
+)
+
+// errBlockTimeMoved rejects the block time of configs written before it
+// became part of the genesis, ignoring it would silently change the slot.
+var errBlockTimeMoved = errors.New("block time now lives in the genesis file, see genesis_file")
+
+type MempoolConfig struct {
+	// MaxTxs and MaxBytes bound the mempool, zero means unbounded.
+	MaxTxs   int `yaml:"max_txs"`
+	MaxBytes int `yaml:"max_bytes"`
+	// Expiry is how long a transaction may wait in the mempool, zero keeps
+	// it until it is included in a block.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// Config is the on disk representation of a node configuration. It gets
+// loaded from a YAML file and can be overridden with BLOCKER_* environment
+// variables, see LoadConfig.
+type Config struct {
+	ListenAddr     string        `yaml:"listen_addr"`
+	BootstrapNodes []string      `yaml:"bootstrap_nodes"`
+	DataDir        string        `yaml:"data_dir"`
+	ValidatorKey   string        `yaml:"validator_key"`
+	Mempool        MempoolConfig `yaml:"mempool"`
+	LogLevel       string        `yaml:"log_level"`
+	GenesisFile    string        `yaml:"genesis_file"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":3000",
+		Mempool:    MempoolConfig{Expiry: defaultMempoolExpiry},
+		LogLevel:   "info",
+	}
+}
+
+// LoadConfig reads the config at path on top of the defaults, an empty path
+// skips the file, and applies the environment overrides afterwards.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// block_time is decoded on the side to tell old configs what to do
+		file := struct {
+			Config    `yaml:",inline"`
+			BlockTime interface{} `yaml:"block_time"`
+		}{Config: *cfg}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing config %s: %w", path, err)
+		}
+		if file.BlockTime != nil {
+			return nil, fmt.Errorf("parsing config %s: block_time: %w", path, errBlockTimeMoved)
+		}
+		*cfg = file.Config
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if _, ok := lookup(envPrefix + "BLOCK_TIME"); ok {
+		return fmt.Errorf("%sBLOCK_TIME: %w", envPrefix, errBlockTimeMoved)
+	}
+
+	strs := map[string]*string{
+		"LISTEN_ADDR":   &cfg.ListenAddr,
+		"DATA_DIR":      &cfg.DataDir,
+		"VALIDATOR_KEY": &cfg.ValidatorKey,
+		"LOG_LEVEL":     &cfg.LogLevel,
+		"GENESIS_FILE":  &cfg.GenesisFile,
+	}
+	for name, field := range strs {
+		if v, ok := lookup(envPrefix + name); ok {
+			*field = v
+		}
+	}
+
+	ints := map[string]*int{
+		"MEMPOOL_MAX_TXS":   &cfg.Mempool.MaxTxs,
+		"MEMPOOL_MAX_BYTES": &cfg.Mempool.MaxBytes,
+	}
+	for name, field := range ints {
+		if v, ok := lookup(envPrefix + name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s%s: %w", envPrefix, name, err)
+			}
+			*field = n
+		}
+	}
+
+	if v, ok := lookup(envPrefix + "MEMPOOL_EXPIRY"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid %sMEMPOOL_EXPIRY: %w", envPrefix, err)
+		}
+		cfg.Mempool.Expiry = d
+	}
+
+	if v, ok := lookup(envPrefix + "BOOTSTRAP_NODES"); ok {
+		cfg.BootstrapNodes = SplitList(v)
+	}
+
+	return nil
+}
+
+// Validate reports every problem with the config at once so they can all be
+// fixed before the node is started.
+func (cfg *Config) Validate() error {
+	errs := []error{}
+	if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr: %w", err))
+	}
+	for _, addr := range cfg.BootstrapNodes {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("bootstrap_nodes: %w", err))
+		}
+	}
+	if cfg.ValidatorKey != "" {
+		if _, err := os.Stat(cfg.ValidatorKey); err != nil {
+			errs = append(errs, fmt.Errorf("validator_key: %w", err))
+		}
+	}
+	if cfg.Mempool.MaxTxs < 0 {
+		errs = append(errs, fmt.Errorf("mempool.max_txs: must not be negative, got %d", cfg.Mempool.MaxTxs))
+	}
+	if cfg.Mempool.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("mempool.max_bytes: must not be negative, got %d", cfg.Mempool.MaxBytes))
+	}
+	if cfg.Mempool.Expiry < 0 {
+		errs = append(errs, fmt.Errorf("mempool.expiry: must not be negative, got %s", cfg.Mempool.Expiry))
+	}
+	if _, err := parseLogLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %w", err))
+	}
+	if cfg.GenesisFile != "" {
+		if _, err := os.Stat(cfg.GenesisFile); err != nil {
+			errs = append(errs, fmt.Errorf("genesis_file: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ServerConfig validates the config and turns it into the settings the
+// node runs with, loading the validator key from disk.
+func (cfg *Config) ServerConfig(version string) (ServerConfig, error) {
+	if err := cfg.Validate(); err != nil {
+		return ServerConfig{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	sc := ServerConfig{
+		Version:         version,
+		ListenAddr:      cfg.ListenAddr,
+		DataDir:         cfg.DataDir,
+		MempoolMaxTxs:   cfg.Mempool.MaxTxs,
+		MempoolMaxBytes: cfg.Mempool.MaxBytes,
+		MempoolExpiry:   cfg.Mempool.Expiry,
+		LogLevel:        cfg.LogLevel,
+		GenesisFile:     cfg.GenesisFile,
+	}
+	if cfg.ValidatorKey != "" {
+		pk, err := ReadKeyFile(cfg.ValidatorKey)
+		if err != nil {
+			return ServerConfig{}, err
+		}
+		sc.PrivateKey = pk
+	}
+
+	return sc, nil
+}
+
+// ReadKeyFile reads a private key stored as a hex encoded seed.
+func ReadKeyFile(path string) (*crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in %s: %w", path, err)
+	}
+	if len(seed) != crypto.SeedLen {
+		return nil, fmt.Errorf("invalid key length (%d) in %s", len(seed), path)
+	}
+
+	return crypto.NewPrivateKeyFromSeed(seed), nil
+}
+
+func parseLogLevel(s string) (zapcore.Level, error) {
+	var lvl zapcore.Level
+	err := lvl.UnmarshalText([]byte(s))
+	return lvl, err
+}
+
+// SplitList splits a comma separated list, dropping blank items.
+func SplitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
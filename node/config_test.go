@@ -0,0 +1,100 @@
+package node
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.Nil(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeFile(t, "blocker.yaml", `
+listen_addr: ":4000"
+bootstrap_nodes: [":3000", ":3001"]
+data_dir: /tmp/blocker
+mempool:
+  max_txs: 100
+log_level: debug
+`)
+	t.Setenv("BLOCKER_LISTEN_ADDR", ":5000")
+	t.Setenv("BLOCKER_MEMPOOL_MAX_BYTES", "4096")
+	t.Setenv("BLOCKER_MEMPOOL_EXPIRY", "1h30m")
+	t.Setenv("BLOCKER_BOOTSTRAP_NODES", ":3002, :3003")
+
+	cfg, err := LoadConfig(path)
+	require.Nil(t, err)
+	assert.Equal(t, ":5000", cfg.ListenAddr)
+	assert.Equal(t, []string{":3002", ":3003"}, cfg.BootstrapNodes)
+	assert.Equal(t, "/tmp/blocker", cfg.DataDir)
+	assert.Equal(t, MempoolConfig{MaxTxs: 100, MaxBytes: 4096, Expiry: 90 * time.Minute}, cfg.Mempool)
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	_, err := LoadConfig(writeFile(t, "blocker.yaml", "listen_port: 3000\n"))
+	assert.NotNil(t, err)
+
+	t.Setenv("BLOCKER_MEMPOOL_MAX_TXS", "many")
+	_, err = LoadConfig("")
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigBlockTime(t *testing.T) {
+	_, err := LoadConfig(writeFile(t, "blocker.yaml", "listen_addr: \":4000\"\nblock_time: 5s\n"))
+	assert.ErrorIs(t, err, errBlockTimeMoved)
+
+	t.Setenv("BLOCKER_BLOCK_TIME", "5s")
+	_, err = LoadConfig("")
+	assert.ErrorIs(t, err, errBlockTimeMoved)
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ListenAddr = "3000"
+	cfg.Mempool.MaxTxs = -1
+	cfg.Mempool.Expiry = -time.Second
+	cfg.LogLevel = "loud"
+	cfg.ValidatorKey = filepath.Join(t.TempDir(), "missing.key")
+
+	err := cfg.Validate()
+	require.NotNil(t, err)
+	for _, field := range []string{"listen_addr", "mempool.max_txs", "mempool.expiry", "log_level", "validator_key"} {
+		assert.Contains(t, err.Error(), field)
+	}
+	_, err = cfg.ServerConfig("blocker-test")
+	assert.NotNil(t, err)
+}
+
+func TestConfigServerConfig(t *testing.T) {
+	pk := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	cfg := DefaultConfig()
+	cfg.ValidatorKey = writeFile(t, "validator.key", hex.EncodeToString(pk.Bytes()[:crypto.SeedLen])+"\n")
+	cfg.Mempool.MaxTxs = 1
+
+	sc, err := cfg.ServerConfig("blocker-test")
+	require.Nil(t, err)
+	assert.Equal(t, pk.Public().Bytes(), sc.PrivateKey.Public().Bytes())
+
+	n, err := NewNode(sc)
+	require.Nil(t, err)
+	assert.True(t, n.mempool.Add(genesisSpend(t, n.chain), 0))
+	assert.False(t, n.mempool.Add(&proto.Transaction{Version: 1}, 0))
+}
+
+func TestSplitList(t *testing.T) {
+	assert.Equal(t, []string{}, SplitList(""))
+	assert.Equal(t, []string{":3000", ":4000"}, SplitList(" :3000,, :4000 ,"))
+}
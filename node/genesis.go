@@ -0,0 +1,288 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/wvalencia19/blocker/consensus"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+const godSeed = "1c0fbc3e5edd3857c5882c88a84c52de0e10c442f6ed818b61a8f0a5971b8653"
+
+const DevChainID = "blocker-dev"
+
+const defaultBlockTime = time.Second * 5
+
+const defaultRetargetInterval = 10
+
+const defaultSubsidy = 50
+
+const (
+	EnginePoA = "poa"
+	EnginePoW = "pow"
+	EngineBFT = "bft"
+)
+
+// Duration is a time.Duration written as a string like "5s" in JSON.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+type Allocation struct {
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"`
+}
+
+type GenesisValidator struct {
+	PublicKey string `json:"public_key"`
+}
+
+// Genesis describes the initial state of a network. Every node of the
+// network has to start from the same genesis to agree on the chain.
+type Genesis struct {
+	ChainID   string    `json:"chain_id"`
+	Timestamp time.Time `json:"timestamp"`
+	// Engine picks the consensus, proof of authority when empty. The bft
+	// engine follows the same proposer schedule and finalizes blocks.
+	Engine string `json:"engine,omitempty"`
+	// BlockTime is the length of a validator slot.
+	BlockTime Duration `json:"block_time"`
+	// Difficulty is the number of leading zero bits proof of work block
+	// hashes need at first, the target gets retargeted every
+	// RetargetInterval blocks to keep blocks BlockTime apart.
+	Difficulty       int `json:"difficulty,omitempty"`
+	RetargetInterval int `json:"retarget_interval,omitempty"`
+	// Subsidy is paid to the producer of every block on top of the fees of
+	// the transactions in it.
+	Subsidy    int64              `json:"subsidy,omitempty"`
+	Alloc      []Allocation       `json:"alloc"`
+	Validators []GenesisValidator `json:"validators,omitempty"`
+}
+
+// DefaultGenesis is the development network, it funds and lets the well
+// known god key validate.
+func DefaultGenesis() *Genesis {
+	pubKey := crypto.NewPrivateKeyFromSeedStr(godSeed).Public()
+
+	return &Genesis{
+		ChainID:   DevChainID,
+		Timestamp: time.Unix(0, 0).UTC(),
+		BlockTime: Duration{defaultBlockTime},
+		Subsidy:   defaultSubsidy,
+		Alloc: []Allocation{
+			{Address: pubKey.Address().String(), Amount: 1000},
+		},
+		Validators: []GenesisValidator{
+			{PublicKey: hex.EncodeToString(pubKey.Bytes())},
+		},
+	}
+}
+
+func LoadGenesis(path string) (*Genesis, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Genesis{}
+	if err := json.Unmarshal(b, g); err != nil {
+		return nil, fmt.Errorf("parsing genesis %s: %w", path, err)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid genesis %s: %w", path, err)
+	}
+
+	return g, nil
+}
+
+func (g *Genesis) Save(path string) error {
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func (g *Genesis) Validate() error {
+	errs := []error{}
+	if g.ChainID == "" {
+		errs = append(errs, fmt.Errorf("chain_id: must not be empty"))
+	}
+	if g.BlockTime.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("block_time: must be positive, got %s", g.BlockTime))
+	}
+	if g.Subsidy < 0 {
+		errs = append(errs, fmt.Errorf("subsidy: must not be negative, got %d", g.Subsidy))
+	}
+	for i, alloc := range g.Alloc {
+		if _, err := decodeAddress(alloc.Address); err != nil {
+			errs = append(errs, fmt.Errorf("alloc[%d]: %w", i, err))
+		}
+		if alloc.Amount <= 0 {
+			errs = append(errs, fmt.Errorf("alloc[%d]: amount must be positive, got %d", i, alloc.Amount))
+		}
+	}
+	switch g.Engine {
+	case "", EnginePoA, EngineBFT:
+		if len(g.Validators) == 0 {
+			errs = append(errs, fmt.Errorf("validators: at least one validator is required"))
+		}
+	case EnginePoW:
+		if g.Difficulty < 0 || g.Difficulty > 255 {
+			errs = append(errs, fmt.Errorf("difficulty: must be between 0 and 255, got %d", g.Difficulty))
+		}
+		if g.RetargetInterval != 0 && g.RetargetInterval < 2 {
+			errs = append(errs, fmt.Errorf("retarget_interval: must be at least 2, got %d", g.RetargetInterval))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("engine: unknown consensus engine %q", g.Engine))
+	}
+	seen := make(map[string]bool)
+	for i, v := range g.Validators {
+		if _, err := decodePublicKey(v.PublicKey); err != nil {
+			errs = append(errs, fmt.Errorf("validators[%d]: %w", i, err))
+		}
+		if seen[v.PublicKey] {
+			errs = append(errs, fmt.Errorf("validators[%d]: duplicate public key %s", i, v.PublicKey))
+		}
+		seen[v.PublicKey] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// Consensus sets up the consensus engine of the network.
+func (g *Genesis) Consensus() (consensus.Engine, error) {
+	if g.Engine == EnginePoW {
+		return consensus.NewPoW(g.Difficulty, g.BlockTime.Duration, g.retargetInterval())
+	}
+
+	keys := make([]*crypto.PublicKey, len(g.Validators))
+	for i, v := range g.Validators {
+		pubKey, err := decodePublicKey(v.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = pubKey
+	}
+	if g.Engine == EngineBFT {
+		return consensus.NewBFT(keys, g.BlockTime.Duration)
+	}
+	return consensus.NewPoA(keys, g.BlockTime.Duration)
+}
+
+// Block builds the genesis block, a single transaction paying out the
+// allocations in order. The block is not signed so that every node derives
+// the same block from the same file without knowing any private key.
+func (g *Genesis) Block() (*proto.Block, error) {
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx := &proto.Transaction{
+		Version: 1,
+		ChainID: g.ChainID,
+		Inputs:  []*proto.TxInput{},
+		Outputs: []*proto.TxOutput{},
+	}
+	for _, alloc := range g.Alloc {
+		addr, err := decodeAddress(alloc.Address)
+		if err != nil {
+			return nil, err
+		}
+		tx.Outputs = append(tx.Outputs, &proto.TxOutput{
+			Amount:  alloc.Amount,
+			Address: addr.Bytes(),
+		})
+	}
+
+	block := &proto.Block{
+		Header: &proto.Header{
+			Version:   1,
+			Timestamp: g.Timestamp.UnixNano(),
+			ChainID:   g.ChainID,
+		},
+		Transactions: []*proto.Transaction{tx},
+	}
+	if g.Engine == EnginePoW {
+		block.Header.Bits = consensus.DifficultyToBits(g.Difficulty)
+	}
+	if err := types.SetRootHash(block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// Coinbase builds the first transaction of the block at height, paying the
+// subsidy plus fees to addr.
+func (g *Genesis) Coinbase(height int, addr crypto.Address, fees int64) *proto.Transaction {
+	tx := &proto.Transaction{
+		Version: 1,
+		ChainID: g.ChainID,
+		Height:  int32(height),
+		Inputs:  []*proto.TxInput{},
+		Outputs: []*proto.TxOutput{},
+	}
+	if reward := g.Subsidy + fees; reward > 0 {
+		tx.Outputs = append(tx.Outputs, &proto.TxOutput{
+			Amount:  reward,
+			Address: addr.Bytes(),
+		})
+	}
+	return tx
+}
+
+func (g *Genesis) retargetInterval() int {
+	if g.RetargetInterval == 0 {
+		return defaultRetargetInterval
+	}
+	return g.RetargetInterval
+}
+
+func decodeAddress(s string) (crypto.Address, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return crypto.Address{}, fmt.Errorf("invalid address %q: %w", s, err)
+	}
+	if len(b) != crypto.AddressLen {
+		return crypto.Address{}, fmt.Errorf("invalid address length (%d)", len(b))
+	}
+	return crypto.AddressFromBytes(b), nil
+}
+
+func decodePublicKey(s string) (*crypto.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %w", s, err)
+	}
+	if len(b) != crypto.PubKeyLen {
+		return nil, fmt.Errorf("invalid public key length (%d)", len(b))
+	}
+	return crypto.PublicKeyFromBytes(b), nil
+}
@@ -0,0 +1,123 @@
+package node
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/consensus"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+func testGenesis(t *testing.T, chainID string, funded ...crypto.Address) *Genesis {
+	g := &Genesis{
+		ChainID:   chainID,
+		Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		BlockTime: Duration{time.Second},
+		Validators: []GenesisValidator{
+			{PublicKey: hex.EncodeToString(crypto.GeneratePrivatekey().Public().Bytes())},
+		},
+	}
+	for _, addr := range funded {
+		g.Alloc = append(g.Alloc, Allocation{Address: addr.String(), Amount: 500})
+	}
+	require.Nil(t, g.Validate())
+	return g
+}
+
+func TestGenesisSaveLoad(t *testing.T) {
+	g := testGenesis(t, "testnet", crypto.GeneratePrivatekey().Public().Address())
+	path := filepath.Join(t.TempDir(), "genesis.json")
+	require.Nil(t, g.Save(path))
+
+	loaded, err := LoadGenesis(path)
+	require.Nil(t, err)
+	assert.Equal(t, g, loaded)
+
+	b1, err := g.Block()
+	require.Nil(t, err)
+	b2, err := loaded.Block()
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(b1), types.HashBlock(b2))
+}
+
+func TestGenesisValidate(t *testing.T) {
+	g := &Genesis{
+		Subsidy:    -1,
+		Alloc:      []Allocation{{Address: "cafe", Amount: 0}},
+		Validators: []GenesisValidator{{PublicKey: "aa"}, {PublicKey: "aa"}},
+	}
+	err := g.Validate()
+	require.NotNil(t, err)
+	for _, msg := range []string{"chain_id", "block_time", "subsidy", "invalid address length", "amount must be positive", "invalid public key length", "duplicate public key"} {
+		assert.Contains(t, err.Error(), msg)
+	}
+	_, err = g.Block()
+	assert.NotNil(t, err)
+}
+
+func TestOpenChainWithGenesis(t *testing.T) {
+	alice := crypto.GeneratePrivatekey().Public().Address()
+	bob := crypto.GeneratePrivatekey().Public().Address()
+	g := testGenesis(t, "testnet", alice, bob)
+
+	chain, err := OpenChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore(), g)
+	require.Nil(t, err)
+	assert.Equal(t, g, chain.Genesis())
+	for _, addr := range []crypto.Address{alice, bob} {
+		balance, err := chain.GetBalance(addr)
+		require.Nil(t, err)
+		assert.Equal(t, int64(500), balance)
+	}
+	balance, err := chain.GetBalance(crypto.NewPrivateKeyFromSeedStr(godSeed).Public().Address())
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func TestOpenChainGenesisMismatch(t *testing.T) {
+	db, err := OpenDB(t.TempDir())
+	require.Nil(t, err)
+	defer db.Close()
+	bs, err := NewBoltBlockStore(db)
+	require.Nil(t, err)
+	txStore, err := NewBoltTXStore(db)
+	require.Nil(t, err)
+	utxoStore, err := NewBoltUTXOStore(db)
+	require.Nil(t, err)
+
+	_, err = OpenChain(bs, txStore, utxoStore, DefaultGenesis())
+	require.Nil(t, err)
+	_, err = OpenChain(bs, txStore, utxoStore, DefaultGenesis())
+	require.Nil(t, err)
+	_, err = OpenChain(bs, txStore, utxoStore, testGenesis(t, "testnet"))
+	assert.NotNil(t, err)
+}
+
+func TestGenesisEngine(t *testing.T) {
+	g := testGenesis(t, "testnet")
+	engine, err := g.Consensus()
+	require.Nil(t, err)
+	assert.IsType(t, &consensus.PoA{}, engine)
+
+	g.Engine = EngineBFT
+	engine, err = g.Consensus()
+	require.Nil(t, err)
+	assert.IsType(t, &consensus.BFT{}, engine)
+
+	g.Engine = EnginePoW
+	g.Difficulty = 10
+	g.Validators = nil
+	require.Nil(t, g.Validate())
+	engine, err = g.Consensus()
+	require.Nil(t, err)
+	assert.IsType(t, &consensus.PoW{}, engine)
+
+	g.Difficulty = 300
+	assert.ErrorContains(t, g.Validate(), "difficulty")
+	g.Engine = "pos"
+	assert.ErrorContains(t, g.Validate(), "unknown consensus engine")
+}
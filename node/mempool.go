@@ -0,0 +1,709 @@
+package node
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	pb "google.golang.org/protobuf/proto"
+)
+
+var (
+	ErrInMempool       = errors.New("transaction already in the mempool")
+	ErrMempoolConflict = errors.New("transaction spends an output another mempool transaction spends")
+	ErrMempoolFull     = errors.New("mempool is full")
+	ErrUnderpaid       = errors.New("replacement doesn't pay more than the transactions it replaces")
+)
+
+// mempoolEntry is a pool transaction along with what the pool orders it by.
+type mempoolEntry struct {
+	tx    *proto.Transaction
+	hash  string
+	fee   int64
+	size  int
+	added time.Time
+	// descFee and descSize add up the entry and its pool descendants, the
+	// package evicted along with it.
+	descFee  int64
+	descSize int
+	// index is the position of the entry in the eviction heap, -1 when it
+	// isn't in it.
+	index int
+}
+
+// descendantPackage returns e with its descendants as a package, only the
+// root, fee and size are set.
+func (e *mempoolEntry) descendantPackage() *txPackage {
+	return &txPackage{root: e, fee: e.descFee, size: e.descSize}
+}
+
+// txPackage is a set of pool transactions that go into a block together, a
+// transaction with the ancestors it needs or with the descendants that need
+// it. Its entries are ordered parents first.
+type txPackage struct {
+	root    *mempoolEntry
+	entries []*mempoolEntry
+	fee     int64
+	size    int
+}
+
+func (p *txPackage) add(e *mempoolEntry) {
+	p.entries = append(p.entries, e)
+	p.fee += e.fee
+	p.size += e.size
+}
+
+// betterThan reports whether p pays a higher fee per byte than other,
+// comparing the products to stay away from rounding. Ties go to the package
+// with the older root and then to the hash so the order is stable.
+func (p *txPackage) betterThan(other *txPackage) bool {
+	a, b := p.fee*int64(other.size), other.fee*int64(p.size)
+	if a != b {
+		return a > b
+	}
+	if !p.root.added.Equal(other.root.added) {
+		return p.root.added.Before(other.root.added)
+	}
+	return p.root.hash < other.root.hash
+}
+
+// packageHeap pops the best paying package first.
+type packageHeap []*txPackage
+
+func (h packageHeap) Len() int            { return len(h) }
+func (h packageHeap) Less(i, j int) bool  { return h[i].betterThan(h[j]) }
+func (h packageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *packageHeap) Push(x interface{}) { *h = append(*h, x.(*txPackage)) }
+func (h *packageHeap) Pop() interface{} {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// evictionHeap orders the pool entries by the fee rate they pay along with
+// their descendants, the cheapest on top.
+type evictionHeap []*mempoolEntry
+
+func (h evictionHeap) Len() int { return len(h) }
+func (h evictionHeap) Less(i, j int) bool {
+	return h[j].descendantPackage().betterThan(h[i].descendantPackage())
+}
+func (h evictionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *evictionHeap) Push(x interface{}) {
+	e := x.(*mempoolEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *evictionHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// Mempool holds the transactions waiting to be included in a block. Pool
+// transactions may spend the outputs of other pool transactions, blocks
+// get the best paying packages of a transaction and its ancestors first, so
+// a child paying a high fee gets its parents in. When the pool is full the
+// cheapest transactions make room for better paying ones, and transactions
+// that waited longer than the expiry are dropped.
+type Mempool struct {
+	lock sync.RWMutex
+	txx  map[string]*mempoolEntry
+	// spends maps the outputs spent by pool transactions to their hash.
+	spends map[string]string
+	// maxTxs and maxBytes limit the pool, expiry how long a transaction may
+	// stay in it. Zero disables the limit.
+	maxTxs   int
+	maxBytes int
+	expiry   time.Duration
+	size     int
+	// evictions keeps the entries ordered for a full pool to find the
+	// cheapest ones without going through all of them.
+	evictions evictionHeap
+}
+
+func NewMempool(maxTxs, maxBytes int, expiry time.Duration) *Mempool {
+	return &Mempool{
+		txx:      make(map[string]*mempoolEntry),
+		spends:   make(map[string]string),
+		maxTxs:   maxTxs,
+		maxBytes: maxBytes,
+		expiry:   expiry,
+	}
+}
+
+// Clear empties the pool and returns its transactions in the order Select
+// would.
+func (pool *Mempool) Clear() []*proto.Transaction {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	txx := transactions(pool.template(math.MaxInt))
+	pool.txx = make(map[string]*mempoolEntry)
+	pool.spends = make(map[string]string)
+	pool.size = 0
+	pool.evictions = nil
+	return txx
+}
+
+func (pool *Mempool) Len() int {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return len(pool.txx)
+}
+
+// Size returns the number of bytes the pool transactions take.
+func (pool *Mempool) Size() int {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.size
+}
+
+func (pool *Mempool) Has(tx *proto.Transaction) bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	hash := hex.EncodeToString(types.HashTransaction(tx))
+	_, ok := pool.txx[hash]
+	return ok
+}
+
+// Output returns the output with the given key, as in the UTXO store, of a
+// pool transaction.
+func (pool *Mempool) Output(key string) (*UTXO, error) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	i := strings.LastIndex(key, "_")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid output key %s", key)
+	}
+	e, ok := pool.txx[key[:i]]
+	if !ok {
+		return nil, fmt.Errorf("no pool transaction %s", key[:i])
+	}
+	index, err := strconv.Atoi(key[i+1:])
+	if err != nil || index < 0 || index >= len(e.tx.Outputs) {
+		return nil, fmt.Errorf("invalid output key %s", key)
+	}
+
+	output := e.tx.Outputs[index]
+	return &UTXO{
+		Hash:     e.hash,
+		OutIndex: index,
+		Amount:   output.Amount,
+		Address:  hex.EncodeToString(output.Address),
+	}, nil
+}
+
+// Spent reports whether a pool transaction spends the output with the
+// given key.
+func (pool *Mempool) Spent(key string) bool {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	_, ok := pool.spends[key]
+	return ok
+}
+
+// Unspent returns the outputs of pool transactions paying the hex encoded
+// address that no other pool transaction spends.
+func (pool *Mempool) Unspent(addr string) []*UTXO {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	utxos := []*UTXO{}
+	for _, e := range pool.txx {
+		for i, output := range e.tx.Outputs {
+			if hex.EncodeToString(output.Address) != addr {
+				continue
+			}
+			if _, ok := pool.spends[fmt.Sprintf("%s_%d", e.hash, i)]; ok {
+				continue
+			}
+			utxos = append(utxos, &UTXO{
+				Hash:     e.hash,
+				OutIndex: i,
+				Amount:   output.Amount,
+				Address:  addr,
+			})
+		}
+	}
+	return utxos
+}
+
+// BlockConnected removes the transactions of b from the pool and evicts the
+// ones spending an output a transaction of b spends, along with their
+// descendants.
+func (pool *Mempool) BlockConnected(c *Chain, b *proto.Block) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	conflicts := make(map[string]*mempoolEntry)
+	for _, tx := range b.Transactions {
+		if e, ok := pool.txx[hex.EncodeToString(types.HashTransaction(tx))]; ok {
+			pool.remove(e)
+		}
+		for _, input := range tx.Inputs {
+			if hash, ok := pool.spends[outpointKey(input)]; ok {
+				pool.descendants(pool.txx[hash], conflicts)
+			}
+		}
+	}
+	for hash := range conflicts {
+		if _, ok := pool.txx[hash]; !ok {
+			delete(conflicts, hash)
+		}
+	}
+	pool.removeAll(conflicts)
+}
+
+// BlockDisconnected puts the transactions of b back into the pool when they
+// are valid on the chain b got disconnected from, and evicts the ones
+// spending the outputs of its coinbase, which is gone for good.
+func (pool *Mempool) BlockDisconnected(c *Chain, b *proto.Block) {
+	for _, tx := range b.Transactions {
+		if types.IsCoinbase(tx) {
+			continue
+		}
+		if fee, err := c.MempoolTransactionFee(tx, pool); err == nil {
+			pool.Add(tx, fee)
+		}
+	}
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	orphans := make(map[string]*mempoolEntry)
+	for _, tx := range b.Transactions {
+		if !types.IsCoinbase(tx) {
+			continue
+		}
+		hash := hex.EncodeToString(types.HashTransaction(tx))
+		for i := range tx.Outputs {
+			if spender, ok := pool.spends[fmt.Sprintf("%s_%d", hash, i)]; ok {
+				pool.descendants(pool.txx[spender], orphans)
+			}
+		}
+	}
+	pool.removeAll(orphans)
+}
+
+// Remove takes tx, and only tx, out of the pool and drops its fee and size
+// from the descendant packages of its ancestors. Transactions spending its
+// outputs stay in the pool.
+func (pool *Mempool) Remove(tx *proto.Transaction) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	e, ok := pool.txx[hex.EncodeToString(types.HashTransaction(tx))]
+	if !ok {
+		return false
+	}
+	pool.remove(e)
+
+	return true
+}
+
+// insert adds e to the pool, updating the descendant packages of its
+// ancestors.
+func (pool *Mempool) insert(e *mempoolEntry) {
+	pool.txx[e.hash] = e
+	for _, input := range e.tx.Inputs {
+		pool.spends[outpointKey(input)] = e.hash
+	}
+	pool.size += e.size
+
+	// a transaction put back after a reorg may have descendants already
+	leaf := len(pool.children(e)) == 0
+	pool.recount(e)
+	heap.Push(&pool.evictions, e)
+	ancestors := pool.ancestors(e)
+	if !leaf {
+		pool.recount(ancestors...)
+		return
+	}
+	for _, ancestor := range ancestors {
+		ancestor.descFee += e.fee
+		ancestor.descSize += e.size
+		pool.fix(ancestor)
+	}
+}
+
+// remove takes e out of the pool, updating the descendant packages of its
+// ancestors.
+func (pool *Mempool) remove(e *mempoolEntry) {
+	ancestors := pool.ancestors(e)
+	leaf := len(pool.children(e)) == 0
+
+	delete(pool.txx, e.hash)
+	for _, input := range e.tx.Inputs {
+		delete(pool.spends, outpointKey(input))
+	}
+	pool.size -= e.size
+	if e.index >= 0 {
+		heap.Remove(&pool.evictions, e.index)
+	}
+
+	if !leaf {
+		pool.recount(ancestors...)
+		return
+	}
+	for _, ancestor := range ancestors {
+		ancestor.descFee -= e.fee
+		ancestor.descSize -= e.size
+		pool.fix(ancestor)
+	}
+}
+
+// removeAll removes the entries of set children first, which keeps the
+// updates of their ancestors cheap, and returns them in that order.
+func (pool *Mempool) removeAll(set map[string]*mempoolEntry) []*mempoolEntry {
+	sorted := pool.sorted(set)
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+	for _, e := range sorted {
+		pool.remove(e)
+	}
+	return sorted
+}
+
+// sorted returns the entries of set parents first.
+func (pool *Mempool) sorted(set map[string]*mempoolEntry) []*mempoolEntry {
+	sorted := make([]*mempoolEntry, 0, len(set))
+	seen := make(map[string]bool)
+	var visit func(e *mempoolEntry)
+	visit = func(e *mempoolEntry) {
+		if seen[e.hash] {
+			return
+		}
+		seen[e.hash] = true
+		for _, parent := range pool.parents(e) {
+			if set[parent.hash] != nil {
+				visit(parent)
+			}
+		}
+		sorted = append(sorted, e)
+	}
+	for _, e := range set {
+		visit(e)
+	}
+	return sorted
+}
+
+// recount adds up the descendant packages of the given entries again.
+func (pool *Mempool) recount(entries ...*mempoolEntry) {
+	for _, e := range entries {
+		set := make(map[string]*mempoolEntry)
+		pool.descendants(e, set)
+		e.descFee, e.descSize = 0, 0
+		for _, d := range set {
+			e.descFee += d.fee
+			e.descSize += d.size
+		}
+		pool.fix(e)
+	}
+}
+
+// fix moves e to its place in the eviction heap after its descendant
+// package changed.
+func (pool *Mempool) fix(e *mempoolEntry) {
+	if e.index >= 0 {
+		heap.Fix(&pool.evictions, e.index)
+	}
+}
+
+func (pool *Mempool) Add(tx *proto.Transaction, fee int64) bool {
+	return pool.Admit(tx, fee) == nil
+}
+
+// Admit adds tx paying fee to the pool unless it is already in it. A
+// transaction spending an output another pool transaction spends is
+// rejected, unless every transaction it conflicts with is replaceable and
+// tx pays a higher fee than they and their descendants together, which all
+// get evicted. A full pool evicts its cheapest transactions along with their
+// descendants to make room, but only when they pay a lower fee rate than tx
+// does. It doesn't validate tx against the chain.
+func (pool *Mempool) Admit(tx *proto.Transaction, fee int64) error {
+	return pool.admit(tx, fee, time.Now())
+}
+
+// admit is Admit for a transaction that got into the pool at added, which
+// is when it expires from.
+func (pool *Mempool) admit(tx *proto.Transaction, fee int64, added time.Time) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire(time.Now())
+
+	e := &mempoolEntry{
+		tx:    tx,
+		hash:  hex.EncodeToString(types.HashTransaction(tx)),
+		fee:   fee,
+		size:  pb.Size(tx),
+		added: added,
+		index: -1,
+	}
+	if _, ok := pool.txx[e.hash]; ok {
+		return ErrInMempool
+	}
+	replaced, err := pool.replacements(e)
+	if err != nil {
+		return err
+	}
+	if pool.maxBytes > 0 && e.size > pool.maxBytes {
+		return fmt.Errorf("%w: transaction of %d bytes exceeds the %d byte limit", ErrMempoolFull, e.size, pool.maxBytes)
+	}
+
+	// the ancestors of tx have to stay for it to be valid
+	keep := make(map[string]bool)
+	for _, ancestor := range pool.ancestors(e) {
+		if replaced[ancestor.hash] != nil {
+			return fmt.Errorf("%w: transaction replaces its ancestor %s", ErrMempoolConflict, ancestor.hash)
+		}
+		keep[ancestor.hash] = true
+	}
+
+	// evicted transactions are put back when tx doesn't make it in after all
+	evicted := pool.removeAll(replaced)
+	kept := []*mempoolEntry{}
+	newcomer := &txPackage{root: e}
+	newcomer.add(e)
+	for pool.full(len(pool.txx), pool.size, e.size) {
+		// the ancestors of tx are set aside for the cheapest other package
+		for pool.evictions.Len() > 0 && keep[pool.evictions[0].hash] {
+			kept = append(kept, heap.Pop(&pool.evictions).(*mempoolEntry))
+		}
+		if pool.evictions.Len() == 0 || !newcomer.betterThan(pool.evictions[0].descendantPackage()) {
+			pool.restore(kept, evicted)
+			return ErrMempoolFull
+		}
+		set := make(map[string]*mempoolEntry)
+		pool.descendants(pool.evictions[0], set)
+		evicted = append(evicted, pool.removeAll(set)...)
+	}
+	pool.restore(kept, nil)
+	pool.insert(e)
+
+	return nil
+}
+
+// restore puts the entries set aside back into the eviction heap and the
+// evicted ones, in the order they got removed in, back into the pool.
+func (pool *Mempool) restore(kept, evicted []*mempoolEntry) {
+	for _, e := range kept {
+		heap.Push(&pool.evictions, e)
+	}
+	for i := len(evicted) - 1; i >= 0; i-- {
+		pool.insert(evicted[i])
+	}
+}
+
+// replacements returns the pool transactions e would replace: the ones
+// spending an output e spends and their descendants.
+func (pool *Mempool) replacements(e *mempoolEntry) (map[string]*mempoolEntry, error) {
+	replaced := make(map[string]*mempoolEntry)
+	for _, input := range e.tx.Inputs {
+		hash, ok := pool.spends[outpointKey(input)]
+		if !ok {
+			continue
+		}
+		other := pool.txx[hash]
+		if !other.tx.Replaceable {
+			return nil, fmt.Errorf("%w (%s)", ErrMempoolConflict, hash)
+		}
+		pool.descendants(other, replaced)
+	}
+
+	fees := int64(0)
+	for _, other := range replaced {
+		var err error
+		if fees, err = types.AddAmount(fees, other.fee); err != nil {
+			return nil, fmt.Errorf("%w: replaced transactions: %v", ErrUnderpaid, err)
+		}
+	}
+	if len(replaced) > 0 && e.fee <= fees {
+		return nil, fmt.Errorf("%w: pays %d, replaced transactions pay %d", ErrUnderpaid, e.fee, fees)
+	}
+
+	return replaced, nil
+}
+
+// descendants adds e and the pool transactions spending its outputs, and
+// theirs in turn, to set.
+func (pool *Mempool) descendants(e *mempoolEntry, set map[string]*mempoolEntry) {
+	if _, ok := set[e.hash]; ok {
+		return
+	}
+	set[e.hash] = e
+	for _, child := range pool.children(e) {
+		pool.descendants(child, set)
+	}
+}
+
+func (pool *Mempool) children(e *mempoolEntry) []*mempoolEntry {
+	children := []*mempoolEntry{}
+	for i := range e.tx.Outputs {
+		// the key outpointKey gives an input spending that output
+		if hash, ok := pool.spends[fmt.Sprintf("%s_%d", e.hash, i)]; ok {
+			children = append(children, pool.txx[hash])
+		}
+	}
+	return children
+}
+
+func (pool *Mempool) parents(e *mempoolEntry) []*mempoolEntry {
+	parents := []*mempoolEntry{}
+	seen := make(map[string]bool)
+	for _, input := range e.tx.Inputs {
+		hash := hex.EncodeToString(input.PrevTxHash)
+		if parent, ok := pool.txx[hash]; ok && !seen[hash] {
+			seen[hash] = true
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+// ancestorPackage returns e with its pool ancestors that are not in
+// selected, parents first.
+func (pool *Mempool) ancestorPackage(e *mempoolEntry, selected map[string]bool) *txPackage {
+	pkg := &txPackage{root: e}
+	seen := make(map[string]bool)
+	var visit func(e *mempoolEntry)
+	visit = func(e *mempoolEntry) {
+		if seen[e.hash] || selected[e.hash] {
+			return
+		}
+		seen[e.hash] = true
+		for _, parent := range pool.parents(e) {
+			visit(parent)
+		}
+		pkg.add(e)
+	}
+	visit(e)
+	return pkg
+}
+
+// ancestors returns the pool ancestors of e, parents first.
+func (pool *Mempool) ancestors(e *mempoolEntry) []*mempoolEntry {
+	entries := pool.ancestorPackage(e, nil).entries
+	return entries[:len(entries)-1]
+}
+
+// Select returns the transactions to put in a block of at most maxBytes,
+// parents before their children. They are left in the pool.
+func (pool *Mempool) Select(maxBytes int) []*proto.Transaction {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.expire(time.Now())
+	return transactions(pool.template(maxBytes))
+}
+
+// Dump returns the pool transactions along with when they got in, parents
+// first, for the pool to be restored from.
+func (pool *Mempool) Dump() *proto.MempoolDump {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	dump := &proto.MempoolDump{}
+	for _, e := range pool.template(math.MaxInt) {
+		dump.Entries = append(dump.Entries, &proto.MempoolEntry{
+			Transaction: e.tx,
+			Added:       e.added.UnixNano(),
+		})
+	}
+	return dump
+}
+
+func transactions(entries []*mempoolEntry) []*proto.Transaction {
+	txx := make([]*proto.Transaction, len(entries))
+	for i, e := range entries {
+		txx[i] = e.tx
+	}
+	return txx
+}
+
+// template picks the best paying packages of a transaction and its
+// unselected ancestors until maxBytes are used. Picking a package changes
+// the packages of its descendants, which get scored again.
+func (pool *Mempool) template(maxBytes int) []*mempoolEntry {
+	entries := []*mempoolEntry{}
+	size := 0
+	selected := make(map[string]bool)
+	skipped := make(map[string]bool)
+
+	h := &packageHeap{}
+	for _, e := range pool.txx {
+		heap.Push(h, pool.ancestorPackage(e, selected))
+	}
+	for h.Len() > 0 {
+		pkg := heap.Pop(h).(*txPackage)
+		if selected[pkg.root.hash] || skipped[pkg.root.hash] {
+			continue
+		}
+		// ancestors of the package got selected since it was scored
+		if current := pool.ancestorPackage(pkg.root, selected); current.size != pkg.size || current.fee != pkg.fee {
+			heap.Push(h, current)
+			continue
+		}
+		if size+pkg.size > maxBytes {
+			skipped[pkg.root.hash] = true
+			continue
+		}
+
+		for _, e := range pkg.entries {
+			selected[e.hash] = true
+			entries = append(entries, e)
+		}
+		size += pkg.size
+		for _, e := range pkg.entries {
+			for _, child := range pool.children(e) {
+				if !selected[child.hash] {
+					heap.Push(h, pool.ancestorPackage(child, selected))
+				}
+			}
+		}
+	}
+	return entries
+}
+
+func (pool *Mempool) full(count, size, extra int) bool {
+	if pool.maxTxs > 0 && count+1 > pool.maxTxs {
+		return true
+	}
+	return pool.maxBytes > 0 && size+extra > pool.maxBytes
+}
+
+// expire drops the transactions that have been waiting since before the
+// expiry, along with their descendants.
+func (pool *Mempool) expire(now time.Time) {
+	if pool.expiry <= 0 {
+		return
+	}
+	expired := make(map[string]*mempoolEntry)
+	for _, e := range pool.txx {
+		if now.Sub(e.added) > pool.expiry {
+			pool.descendants(e, expired)
+		}
+	}
+	pool.removeAll(expired)
+}
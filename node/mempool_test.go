@@ -0,0 +1,323 @@
+package node
+
+import (
+	"encoding/hex"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	"github.com/wvalencia19/blocker/util"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// poolTx returns a transaction spending a random output, they all have the
+// same size so their fee rates compare like their fees.
+func poolTx() *proto.Transaction {
+	return &proto.Transaction{
+		Version: 1,
+		Inputs:  []*proto.TxInput{{PrevTxHash: util.RandomHash()}},
+	}
+}
+
+func hashes(txx []*proto.Transaction) [][]byte {
+	out := make([][]byte, len(txx))
+	for i, tx := range txx {
+		out[i] = types.HashTransaction(tx)
+	}
+	return out
+}
+
+func TestMempoolConflicts(t *testing.T) {
+	chain := NewChain(NewMemoryBlockStore(), NewMemoryTXStore())
+	pool := NewMempool(0, 0, 0)
+	first := genesisSpend(t, chain)
+	second := genesisSpend(t, chain)
+
+	require.Nil(t, pool.Admit(first, 0))
+	assert.ErrorIs(t, pool.Admit(first, 0), ErrInMempool)
+	assert.ErrorIs(t, pool.Admit(second, 0), ErrMempoolConflict)
+
+	// the output is free again once the spending transaction is gone
+	assert.True(t, pool.Remove(first))
+	require.Nil(t, pool.Admit(second, 0))
+	pool.Clear()
+	require.Nil(t, pool.Admit(first, 0))
+}
+
+func TestMempoolFeeOrder(t *testing.T) {
+	pool := NewMempool(0, 0, 0)
+	low, mid, high := poolTx(), poolTx(), poolTx()
+	require.Nil(t, pool.Admit(mid, 20))
+	require.Nil(t, pool.Admit(low, 10))
+	require.Nil(t, pool.Admit(high, 30))
+
+	// a bigger transaction needs a bigger fee for the same rate
+	big := poolTx()
+	big.Outputs = []*proto.TxOutput{{Amount: 1, Address: make([]byte, 20)}}
+	require.Nil(t, pool.Admit(big, 30*int64(pb.Size(big))/int64(pb.Size(high))-1))
+
+	size := pb.Size(high)
+	assert.Equal(t, 3*size+pb.Size(big), pool.Size())
+	assert.Equal(t, hashes([]*proto.Transaction{high, big, mid, low}), hashes(pool.Select(pool.Size())))
+	// transactions that don't fit are skipped for smaller ones
+	assert.Equal(t, hashes([]*proto.Transaction{high, mid}), hashes(pool.Select(2*size)))
+	assert.Empty(t, pool.Select(size-1))
+	assert.Equal(t, 4, pool.Len())
+
+	assert.Equal(t, hashes([]*proto.Transaction{high, big, mid, low}), hashes(pool.Clear()))
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestMempoolEviction(t *testing.T) {
+	pool := NewMempool(2, 0, 0)
+	low, mid, high := poolTx(), poolTx(), poolTx()
+	require.Nil(t, pool.Admit(low, 10))
+	require.Nil(t, pool.Admit(mid, 20))
+
+	// the full pool only makes room for better paying transactions
+	assert.ErrorIs(t, pool.Admit(poolTx(), 10), ErrMempoolFull)
+	require.Nil(t, pool.Admit(high, 30))
+	assert.False(t, pool.Has(low))
+	assert.True(t, pool.Has(mid))
+	assert.True(t, pool.Has(high))
+
+	size := pb.Size(low)
+	pool = NewMempool(0, 2*size, 0)
+	require.Nil(t, pool.Admit(low, 10))
+	require.Nil(t, pool.Admit(mid, 20))
+	// a transaction twice the size has to outbid everything it evicts
+	big := poolTx()
+	big.Inputs = append(big.Inputs, &proto.TxInput{PrevTxHash: util.RandomHash()})
+	big.Inputs[0].PrevOutIndex = 1
+	require.LessOrEqual(t, pb.Size(big), 2*size)
+	assert.ErrorIs(t, pool.Admit(big, 30), ErrMempoolFull)
+	require.Nil(t, pool.Admit(big, 50))
+	assert.Equal(t, 1, pool.Len())
+	assert.Equal(t, pb.Size(big), pool.Size())
+
+	assert.ErrorIs(t, NewMempool(0, size-1, 0).Admit(low, 100), ErrMempoolFull)
+}
+
+func TestMempoolExpiry(t *testing.T) {
+	pool := NewMempool(0, 0, time.Hour)
+	old, fresh := poolTx(), poolTx()
+	require.Nil(t, pool.Admit(old, 10))
+	require.Nil(t, pool.Admit(fresh, 10))
+	pool.txx[hex.EncodeToString(types.HashTransaction(old))].added = time.Now().Add(-2 * time.Hour)
+
+	assert.Equal(t, hashes([]*proto.Transaction{fresh}), hashes(pool.Select(maxBlockTxBytes)))
+	assert.False(t, pool.Has(old))
+	assert.Equal(t, pb.Size(fresh), pool.Size())
+}
+
+// spending returns a transaction spending output index of prev.
+func spending(prev *proto.Transaction, index uint32) *proto.Transaction {
+	tx := poolTx()
+	tx.Inputs[0].PrevTxHash = types.HashTransaction(prev)
+	tx.Inputs[0].PrevOutIndex = index
+	return tx
+}
+
+func TestMempoolReplaceByFee(t *testing.T) {
+	funding := poolTx()
+	funding.Outputs = []*proto.TxOutput{{Amount: 100}, {Amount: 100}}
+
+	pool := NewMempool(0, 0, 0)
+	final := spending(funding, 0)
+	require.Nil(t, pool.Admit(final, 10))
+	conflict := spending(funding, 0)
+	conflict.Outputs = []*proto.TxOutput{{Amount: 10}}
+	assert.ErrorIs(t, pool.Admit(conflict, 100), ErrMempoolConflict)
+
+	original := spending(funding, 1)
+	original.Replaceable = true
+	original.Outputs = []*proto.TxOutput{{Amount: 50}}
+	child := spending(original, 0)
+	require.Nil(t, pool.Admit(original, 10))
+	require.Nil(t, pool.Admit(child, 5))
+
+	// the replacement pays for the child it evicts as well
+	bump := spending(funding, 1)
+	bump.Outputs = []*proto.TxOutput{{Amount: 45}}
+	assert.ErrorIs(t, pool.Admit(bump, 15), ErrUnderpaid)
+	require.Nil(t, pool.Admit(bump, 16))
+	assert.False(t, pool.Has(original))
+	assert.False(t, pool.Has(child))
+	assert.True(t, pool.Has(final))
+	assert.Equal(t, 2, pool.Len())
+	assert.Equal(t, pb.Size(final)+pb.Size(bump), pool.Size())
+
+	// non replaceable transactions stay once they replaced one
+	assert.ErrorIs(t, pool.Admit(original, 100), ErrMempoolConflict)
+
+	// a replacement frees the room it needs in a full pool
+	full := NewMempool(1, 0, 0)
+	require.Nil(t, full.Admit(original, 10))
+	require.Nil(t, full.Admit(bump, 11))
+	assert.Equal(t, hashes([]*proto.Transaction{bump}), hashes(full.Select(maxBlockTxBytes)))
+
+	// the fees of the replaced transactions can't wrap around to let a
+	// cheap replacement in
+	pool = NewMempool(0, 0, 0)
+	rich, cheap := spending(funding, 0), spending(funding, 1)
+	rich.Replaceable, cheap.Replaceable = true, true
+	require.Nil(t, pool.Admit(rich, math.MaxInt64-1))
+	require.Nil(t, pool.Admit(cheap, 10))
+	both := spending(funding, 0)
+	both.Inputs = append(both.Inputs, spending(funding, 1).Inputs...)
+	assert.ErrorIs(t, pool.Admit(both, 100), ErrUnderpaid)
+	assert.True(t, pool.Has(rich))
+	assert.True(t, pool.Has(cheap))
+}
+
+func TestMempoolPackages(t *testing.T) {
+	funding := poolTx()
+	funding.Outputs = []*proto.TxOutput{{Amount: 100}, {Amount: 100}}
+	parent := spending(funding, 0)
+	parent.Outputs = []*proto.TxOutput{{Amount: 90, Address: make([]byte, 20)}}
+	child := spending(parent, 0)
+	other := spending(funding, 1)
+
+	pool := NewMempool(0, 0, 0)
+	require.Nil(t, pool.Admit(child, 100))
+	require.Nil(t, pool.Admit(parent, 1))
+	require.Nil(t, pool.Admit(other, 20))
+
+	// the child pays for its parent, which has to go first
+	assert.Equal(t, hashes([]*proto.Transaction{parent, child, other}), hashes(pool.Select(pool.Size())))
+	assert.Equal(t, hashes([]*proto.Transaction{other}), hashes(pool.Select(pb.Size(parent)+pb.Size(child)-1)))
+
+	utxo, err := pool.Output(hex.EncodeToString(types.HashTransaction(parent)) + "_0")
+	require.Nil(t, err)
+	assert.Equal(t, int64(90), utxo.Amount)
+	_, err = pool.Output(hex.EncodeToString(types.HashTransaction(parent)) + "_1")
+	assert.NotNil(t, err)
+	assert.True(t, pool.Spent(hex.EncodeToString(types.HashTransaction(parent))+"_0"))
+	assert.Empty(t, pool.Unspent(hex.EncodeToString(make([]byte, 20))))
+
+	// a mined parent leaves its child behind
+	assert.True(t, pool.Remove(parent))
+	assert.True(t, pool.Has(child))
+	assert.Equal(t, hashes([]*proto.Transaction{child, other}), hashes(pool.Clear()))
+}
+
+func TestMempoolPackageEviction(t *testing.T) {
+	funding := poolTx()
+	funding.Outputs = []*proto.TxOutput{{Amount: 100}, {Amount: 100}}
+	parent := spending(funding, 0)
+	parent.Outputs = []*proto.TxOutput{{Amount: 90}}
+	child := spending(parent, 0)
+	other := spending(funding, 1)
+
+	pool := NewMempool(3, 0, 0)
+	require.Nil(t, pool.Admit(parent, 1))
+	require.Nil(t, pool.Admit(child, 100))
+	require.Nil(t, pool.Admit(other, 20))
+
+	// the parent is cheap but its child makes the pair worth keeping
+	assert.ErrorIs(t, pool.Admit(poolTx(), 10), ErrMempoolFull)
+	require.Nil(t, pool.Admit(poolTx(), 30))
+	assert.False(t, pool.Has(other))
+	assert.True(t, pool.Has(parent))
+	assert.True(t, pool.Has(child))
+
+	// ancestors of the newcomer are never evicted for it
+	pool = NewMempool(2, 0, 0)
+	require.Nil(t, pool.Admit(parent, 1))
+	require.Nil(t, pool.Admit(other, 20))
+	require.Nil(t, pool.Admit(child, 30))
+	assert.False(t, pool.Has(other))
+	assert.True(t, pool.Has(parent))
+
+	// evicting or expiring a transaction takes its descendants along
+	require.Nil(t, pool.Admit(other, 50))
+	assert.False(t, pool.Has(parent))
+	assert.False(t, pool.Has(child))
+
+	pool = NewMempool(0, 0, time.Hour)
+	require.Nil(t, pool.Admit(parent, 1))
+	require.Nil(t, pool.Admit(child, 1))
+	pool.txx[hex.EncodeToString(types.HashTransaction(parent))].added = time.Now().Add(-2 * time.Hour)
+	assert.Empty(t, pool.Select(maxBlockTxBytes))
+	assert.Equal(t, 0, pool.Len())
+}
+
+// checkDescendantPackages compares the descendant packages the pool keeps
+// with freshly counted ones and checks the eviction heap holds every entry.
+func checkDescendantPackages(t *testing.T, pool *Mempool) {
+	t.Helper()
+	require.Equal(t, len(pool.txx), pool.evictions.Len())
+	for _, e := range pool.txx {
+		set := make(map[string]*mempoolEntry)
+		pool.descendants(e, set)
+		pkg := &txPackage{}
+		for _, d := range set {
+			pkg.add(d)
+		}
+		assert.Equal(t, pkg.fee, e.descFee, e.hash)
+		assert.Equal(t, pkg.size, e.descSize, e.hash)
+		assert.Equal(t, e, pool.evictions[e.index])
+		if cheapest := pool.evictions[0]; e != cheapest {
+			assert.False(t, cheapest.descendantPackage().betterThan(e.descendantPackage()))
+		}
+	}
+}
+
+func TestMempoolDescendantPackages(t *testing.T) {
+	funding := poolTx()
+	funding.Outputs = []*proto.TxOutput{{Amount: 100}, {Amount: 100}}
+	a := spending(funding, 0)
+	a.Outputs = []*proto.TxOutput{{Amount: 50}, {Amount: 40}}
+	b, c := spending(a, 0), spending(a, 1)
+	b.Outputs = []*proto.TxOutput{{Amount: 45}}
+	c.Outputs = []*proto.TxOutput{{Amount: 35}}
+	// d spends both b and c
+	d := spending(b, 0)
+	d.Inputs = append(d.Inputs, &proto.TxInput{PrevTxHash: types.HashTransaction(c)})
+
+	pool := NewMempool(0, 0, 0)
+	for i, tx := range []*proto.Transaction{a, b, c, d, poolTx()} {
+		require.Nil(t, pool.Admit(tx, int64(10*(i+1))))
+		checkDescendantPackages(t, pool)
+	}
+	assert.Equal(t, int64(10+20+30+40), pool.txx[hex.EncodeToString(types.HashTransaction(a))].descFee)
+
+	// a leaf, then a transaction with descendants left behind
+	require.True(t, pool.Remove(d))
+	checkDescendantPackages(t, pool)
+	require.True(t, pool.Remove(a))
+	checkDescendantPackages(t, pool)
+
+	// back after a reorg, its children are still there
+	require.Nil(t, pool.Admit(a, 10))
+	checkDescendantPackages(t, pool)
+	assert.Equal(t, int64(10+20+30), pool.txx[hex.EncodeToString(types.HashTransaction(a))].descFee)
+
+	// a full pool that doesn't take the newcomer is left as it was
+	pool.maxTxs = pool.Len()
+	assert.ErrorIs(t, pool.Admit(poolTx(), 1), ErrMempoolFull)
+	assert.Equal(t, 4, pool.Len())
+	checkDescendantPackages(t, pool)
+	require.Nil(t, pool.Admit(poolTx(), 1000))
+	checkDescendantPackages(t, pool)
+
+	// evictions are undone when the newcomer doesn't beat every package it
+	// would need to evict
+	cheap, dear := poolTx(), poolTx()
+	size := pb.Size(cheap)
+	pool = NewMempool(0, 2*size, 0)
+	require.Nil(t, pool.Admit(cheap, 10))
+	require.Nil(t, pool.Admit(dear, 100))
+	big := poolTx()
+	for pb.Size(big) <= size+size/2 {
+		big.Outputs = append(big.Outputs, &proto.TxOutput{Amount: 1})
+	}
+	assert.ErrorIs(t, pool.Admit(big, int64(pb.Size(big))*50/int64(size)), ErrMempoolFull)
+	assert.True(t, pool.Has(cheap))
+	assert.True(t, pool.Has(dear))
+	checkDescendantPackages(t, pool)
+}
@@ -1,102 +1,232 @@
 package node
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/wvalencia19/blocker/consensus"
 	"github.com/wvalencia19/blocker/crypto"
 	"github.com/wvalencia19/blocker/proto"
 	"github.com/wvalencia19/blocker/types"
+	bolt "go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	pb "google.golang.org/protobuf/proto"
 )
 
-const blockTime = time.Second * 5
-
-type Mempool struct {
-	lock sync.RWMutex
-	txx  map[string]*proto.Transaction
-}
-
-func NewMempool() *Mempool {
-	return &Mempool{
-		txx: make(map[string]*proto.Transaction),
-	}
+type ServerConfig struct {
+	Version    string
+	ListenAddr string
+	PrivateKey *crypto.PrivateKey
+	// DataDir is where the chain gets persisted, when empty
+	// the node keeps everything in memory.
+	DataDir         string
+	MempoolMaxTxs   int
+	MempoolMaxBytes int
+	MempoolExpiry   time.Duration
+	LogLevel        string
+	GenesisFile     string
 }
 
-func (pool *Mempool) Clear() []*proto.Transaction {
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+type Node struct {
+	ServerConfig
+	logger   *zap.SugaredLogger
+	peerLock sync.RWMutex
 
-	txx := make([]*proto.Transaction, len(pool.txx))
-	i := 0
+	peers   map[proto.NodeClient]*proto.Version
+	mempool *Mempool
+	chain   *Chain
+	// syncLock makes sure we only download blocks from one peer at a time.
+	syncLock sync.Mutex
+	// cancelSeal stops sealing the block we are producing, a block from a
+	// peer makes it stale.
+	sealLock   sync.Mutex
+	cancelSeal context.CancelFunc
+	bft        *bftState
+	server     *grpc.Server
+	// quit stops the validator loop, loops tracks it.
+	quit     chan struct{}
+	stopOnce sync.Once
+	loops    sync.WaitGroup
+	closeDB  func() error
+	// mempoolLoaded is set once the mempool file was read, a node that never
+	// got that far must not overwrite it with its empty pool.
+	mempoolLoaded atomic.Bool
+	proto.UnimplementedNodeServer
+}
 
-	for k, v := range pool.txx {
-		delete(pool.txx, k)
-		txx[i] = v
-		i++
+func NewNode(cfg ServerConfig) (*Node, error) {
+	logger, err := newLogger(cfg.LogLevel)
+	if err != nil {
+		return nil, err
 	}
-	return txx
-}
+	mempool := NewMempool(cfg.MempoolMaxTxs, cfg.MempoolMaxBytes, cfg.MempoolExpiry)
+	chain, closeDB, err := openChain(cfg.DataDir, cfg.GenesisFile)
+	if err != nil {
+		return nil, err
+	}
+	chain.Observe(mempool)
 
-func (pool *Mempool) Len() int {
-	pool.lock.RLock()
-	defer pool.lock.RUnlock()
+	n := &Node{
+		peers:        make(map[proto.NodeClient]*proto.Version),
+		logger:       logger.Sugar(),
+		mempool:      mempool,
+		chain:        chain,
+		bft:          newBFTState(),
+		server:       grpc.NewServer(),
+		quit:         make(chan struct{}),
+		closeDB:      closeDB,
+		ServerConfig: cfg,
+	}
+	proto.RegisterNodeServer(n.server, n)
+	// the engine refuses to prepare blocks for keys that may not produce any
+	if cfg.PrivateKey != nil {
+		if _, err := n.prepareHeader(); err != nil {
+			closeDB()
+			return nil, fmt.Errorf("can't produce blocks on chain %s: %w", chain.Genesis().ChainID, err)
+		}
+	}
 
-	return len(pool.txx)
+	return n, nil
 }
 
-func (pool *Mempool) Has(tx *proto.Transaction) bool {
-	pool.lock.RLock()
-	defer pool.lock.RUnlock()
-
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-	_, ok := pool.txx[hash]
-	return ok
+// mempoolFile is where the mempool is kept across restarts, nodes keeping
+// their chain in memory don't keep it.
+func (n *Node) mempoolFile() string {
+	if n.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(n.DataDir, "mempool.dat")
 }
 
-func (pool *Mempool) Add(tx *proto.Transaction) bool {
-	if pool.Has(tx) {
-		return false
+// saveMempool writes the mempool transactions to the mempool file.
+func (n *Node) saveMempool() error {
+	path := n.mempoolFile()
+	if path == "" {
+		return nil
+	}
+	b, err := pb.Marshal(n.mempool.Dump())
+	if err != nil {
+		return err
+	}
+	// a crash while writing mustn't leave a truncated file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
 	}
+	return os.Rename(tmp, path)
+}
 
-	pool.lock.Lock()
-	defer pool.lock.Unlock()
+// loadMempool puts the transactions of the mempool file back into the
+// mempool, validating them against the current tip. Transactions that got
+// into a block, got double spent or expired in the meantime are dropped.
+func (n *Node) loadMempool() error {
+	path := n.mempoolFile()
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		n.mempoolLoaded.Store(true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dump := &proto.MempoolDump{}
+	if err := pb.Unmarshal(b, dump); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
 
-	hash := hex.EncodeToString(types.HashTransaction(tx))
-	pool.txx[hash] = tx
+	loaded := 0
+	for _, entry := range dump.Entries {
+		added := time.Unix(0, entry.Added)
+		if n.MempoolExpiry > 0 && time.Since(added) > n.MempoolExpiry {
+			continue
+		}
+		fee, err := n.chain.MempoolTransactionFee(entry.Transaction, n.mempool)
+		if err == nil {
+			err = n.mempool.admit(entry.Transaction, fee, added)
+		}
+		if err != nil {
+			n.logger.Debugw("dropping persisted tx", "hash", hex.EncodeToString(types.HashTransaction(entry.Transaction)), "err", err)
+			continue
+		}
+		loaded++
+	}
+	n.logger.Infow("loaded mempool", "txx", loaded, "dropped", len(dump.Entries)-loaded)
+	n.mempoolLoaded.Store(true)
 
-	return true
+	return nil
 }
 
-type ServerConfig struct {
-	Version    string
-	ListenAddr string
-	PrivateKey *crypto.PrivateKey
+func newLogger(level string) (*zap.Logger, error) {
+	logCfg := zap.NewProductionConfig()
+	if level != "" {
+		lvl, err := parseLogLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		logCfg.Level = zap.NewAtomicLevelAt(lvl)
+	}
+	return logCfg.Build()
 }
 
-type Node struct {
-	ServerConfig
-	logger   *zap.SugaredLogger
-	peerLock sync.RWMutex
+func openChain(dataDir, genesisFile string) (*Chain, func() error, error) {
+	genesis := DefaultGenesis()
+	if genesisFile != "" {
+		g, err := LoadGenesis(genesisFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		genesis = g
+	}
+	if dataDir == "" {
+		chain, err := OpenChain(NewMemoryBlockStore(), NewMemoryTXStore(), NewMemoryUTXOStore(), genesis)
+		return chain, func() error { return nil }, err
+	}
 
-	peers   map[proto.NodeClient]*proto.Version
-	mempool *Mempool
-	proto.UnimplementedNodeServer
+	db, err := OpenDB(dataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := boltChain(db, genesis)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return chain, db.Close, nil
 }
 
-func NewNode(cfg ServerConfig) *Node {
-	logger, _ := zap.NewProduction()
-	return &Node{
-		peers:        make(map[proto.NodeClient]*proto.Version),
-		logger:       logger.Sugar(),
-		mempool:      NewMempool(),
-		ServerConfig: cfg,
+func boltChain(db *bolt.DB, genesis *Genesis) (*Chain, error) {
+	bs, err := NewBoltBlockStore(db)
+	if err != nil {
+		return nil, err
 	}
+	txStore, err := NewBoltTXStore(db)
+	if err != nil {
+		return nil, err
+	}
+	utxoStore, err := NewBoltUTXOStore(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenChain(bs, txStore, utxoStore, genesis)
 }
 
 func (n *Node) bootstrapNetwork(addrs []string) error {
@@ -114,16 +244,18 @@ func (n *Node) bootstrapNetwork(addrs []string) error {
 	return nil
 }
 
+// Start serves the node on listenAddr until Stop is called, after putting
+// the transactions the mempool had when the node was last stopped back in.
 func (n *Node) Start(listenAddr string, bootstrapNodes []string) error {
 	n.ListenAddr = listenAddr
-	opts := []grpc.ServerOption{}
-	grpcServer := grpc.NewServer(opts...)
 	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
+	if err := n.loadMempool(); err != nil {
+		n.logger.Errorw("can't load the mempool", "err", err)
+	}
 
-	proto.RegisterNodeServer(grpcServer, n)
 	n.logger.Infow("node started...", "port", listenAddr)
 
 	// bootstrap the network with a list of already know nodes
@@ -133,42 +265,429 @@ func (n *Node) Start(listenAddr string, bootstrapNodes []string) error {
 		go n.bootstrapNetwork(bootstrapNodes)
 
 	}
-	return grpcServer.Serve(ln)
+
+	if n.PrivateKey != nil {
+		n.loops.Add(1)
+		go func() {
+			defer n.loops.Done()
+			n.validatorLoop()
+		}()
+	}
+	return n.server.Serve(ln)
+}
+
+// Stop shuts the node down gracefully: it stops producing blocks, lets the
+// RPCs in flight finish, saves the mempool for the next start and closes
+// the chain. A node whose Start failed before loading the mempool leaves the
+// mempool file alone.
+func (n *Node) Stop() error {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+	})
+	n.interruptSeal()
+	n.loops.Wait()
+	n.server.GracefulStop()
+
+	if !n.mempoolLoaded.Load() {
+		n.logger.Infow("node stopped before loading the mempool", "we", n.ListenAddr)
+		return n.closeDB()
+	}
+	if err := n.saveMempool(); err != nil {
+		n.closeDB()
+		return fmt.Errorf("saving the mempool: %w", err)
+	}
+	n.logger.Infow("node stopped", "mempool", n.mempool.Len(), "we", n.ListenAddr)
+	return n.closeDB()
+}
+
+// maxSlotWait bounds how long the validator sleeps before looking at the
+// tip again, a new block moves its next slot.
+const maxSlotWait = time.Second
+
+func (n *Node) validatorLoop() {
+	n.logger.Infow("starting validator loop", "address", n.PrivateKey.Public().Address())
+
+	for {
+		select {
+		case <-n.quit:
+			return
+		default:
+		}
+
+		header, err := n.prepareHeader()
+		if err != nil {
+			n.logger.Errorw("prepare header error", "err", err)
+			return
+		}
+		if wait := time.Until(time.Unix(0, header.Timestamp)); wait > 0 {
+			n.sleep(min(wait, maxSlotWait))
+			continue
+		}
+
+		err = n.produceBlock()
+		if errors.Is(err, context.Canceled) {
+			n.logger.Debugw("block production interrupted by a new tip")
+			continue
+		}
+		if err != nil {
+			n.logger.Errorw("block production error", "err", err)
+			n.sleep(maxSlotWait)
+		}
+	}
+}
+
+// sleep waits for d, or until the node is stopped.
+func (n *Node) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-n.quit:
+	}
+}
+
+// prepareHeader lets the consensus engine fill in a header on top of the
+// current tip for a block produced by us. With BFT the block builds on the
+// last final block instead, skipping the rounds that already have a
+// proposal, so a proposal that doesn't get finalized is replaced by the one
+// of the next round.
+func (n *Node) prepareHeader() (*proto.Header, error) {
+	engine := n.chain.Consensus()
+	bft, isBFT := engine.(*consensus.BFT)
+
+	prev := n.chain.Tip()
+	if isBFT {
+		prev = n.chain.FinalizedHeader()
+	}
+	header := &proto.Header{
+		Version:  1,
+		Height:   prev.Height + 1,
+		PrevHash: types.HashHeader(prev),
+		ChainID:  n.chain.Genesis().ChainID,
+	}
+
+	now := time.Now()
+	for {
+		if err := engine.PrepareHeader(n.chain, prev, header, n.PrivateKey.Public(), now); err != nil {
+			return header, err
+		}
+		if !isBFT {
+			return header, nil
+		}
+		round := bft.Round(prev, header.Timestamp)
+		if !n.bft.hasProposal(voteRound{height: int(header.Height), round: round}) {
+			return header, nil
+		}
+		now = bft.SlotStart(prev, round+1)
+	}
 }
 
+// maxBlockTxBytes bounds the size of the transactions we put in a block.
+const maxBlockTxBytes = 1 << 20
+
+// produceBlock picks the best paying transactions of the mempool that are
+// valid on top of the block it builds on and appends them as a new sealed
+// block after a coinbase paying us the subsidy and their fees. It fails when
+// it is not our turn to produce one yet.
+func (n *Node) produceBlock() error {
+	header, err := n.prepareHeader()
+	if err != nil {
+		return err
+	}
+	if wait := time.Until(time.Unix(0, header.Timestamp)); wait > 0 {
+		return fmt.Errorf("block at height %d is due in %s", header.Height, wait)
+	}
+
+	// with BFT the block may build on a block below the tip, transactions
+	// depending on the blocks above it are only left out
+	onTip := bytes.Equal(header.PrevHash, types.HashHeader(n.chain.Tip()))
+	txx := []*proto.Transaction{}
+	view := n.chain.newUTXOView(header, nil)
+	fees := int64(0)
+	// txs waiting for a later block, their descendants wait with them
+	held := make(map[string]bool)
+	hold := func(tx *proto.Transaction, err error) {
+		hash := hex.EncodeToString(types.HashTransaction(tx))
+		n.logger.Debugw("leaving tx for a later block", "hash", hash, "err", err)
+		held[hash] = true
+	}
+	for _, tx := range n.mempool.Select(maxBlockTxBytes) {
+		if spendsAny(tx, held) {
+			hold(tx, fmt.Errorf("spends a tx left for a later block"))
+			continue
+		}
+		fee, err := view.fee(tx)
+		if errors.Is(err, ErrTimeLocked) {
+			hold(tx, err)
+			continue
+		}
+		if err != nil {
+			n.dropTransaction(tx, err, onTip)
+			continue
+		}
+		total, err := types.AddAmount(fees, fee)
+		if err == nil {
+			_, err = types.AddAmount(n.chain.Genesis().Subsidy, total)
+		}
+		if err != nil {
+			// the coinbase can't pay out more
+			hold(tx, err)
+			continue
+		}
+		if err := view.apply(tx); err != nil {
+			n.dropTransaction(tx, err, onTip)
+			continue
+		}
+		fees = total
+		txx = append(txx, tx)
+	}
+
+	coinbase := n.chain.Genesis().Coinbase(int(header.Height), n.PrivateKey.Public().Address(), fees)
+	block := &proto.Block{
+		Header:       header,
+		Transactions: append([]*proto.Transaction{coinbase}, txx...),
+	}
+	if err := n.sealBlock(block); err != nil {
+		return err
+	}
+
+	if err := n.chain.AddBlock(block); err != nil {
+		return err
+	}
+	n.logger.Infow("created new block", "height", block.Header.Height, "hash", hex.EncodeToString(types.HashBlock(block)), "txx", len(txx))
+	n.onBlock(block)
+
+	go func() {
+		if err := n.broadcast(block); err != nil {
+			n.logger.Errorw("broadcast error", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// spendsAny reports whether tx spends an output of one of the transactions
+// with the given hex encoded hashes.
+func spendsAny(tx *proto.Transaction, hashes map[string]bool) bool {
+	for _, input := range tx.Inputs {
+		if hashes[hex.EncodeToString(input.PrevTxHash)] {
+			return true
+		}
+	}
+	return false
+}
+
+// dropTransaction leaves tx out of the block being produced. It is removed
+// from the pool too when the block builds on the tip, on top of which it is
+// invalid for good.
+func (n *Node) dropTransaction(tx *proto.Transaction, err error, onTip bool) {
+	n.logger.Debugw("skipping tx", "hash", hex.EncodeToString(types.HashTransaction(tx)), "err", err)
+	if onTip {
+		n.mempool.Remove(tx)
+	}
+}
+
+func (n *Node) sealBlock(b *proto.Block) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n.sealLock.Lock()
+	n.cancelSeal = cancel
+	select {
+	case <-n.quit:
+		// Stop already interrupted whatever was being sealed
+		cancel()
+	default:
+	}
+	n.sealLock.Unlock()
+
+	return n.chain.Consensus().Seal(ctx, n.PrivateKey, b)
+}
+
+func (n *Node) interruptSeal() {
+	n.sealLock.Lock()
+	defer n.sealLock.Unlock()
+
+	if n.cancelSeal != nil {
+		n.cancelSeal()
+		n.cancelSeal = nil
+	}
+}
+
+// HandleTransaction admits a transaction into the mempool and gossips it
+// further. Rejected transactions get a gRPC status error telling the sender
+// why: InvalidArgument for transactions that can never be valid,
+// AlreadyExists for ones we already have, FailedPrecondition for ones that
+// conflict with the chain or the mempool and ResourceExhausted when the
+// mempool is full.
 func (n *Node) HandleTransaction(ctx context.Context, tx *proto.Transaction) (*proto.Ack, error) {
-	peer, _ := peer.FromContext(ctx)
 	hash := hex.EncodeToString(types.HashTransaction(tx))
+	if err := n.admitTransaction(tx); err != nil {
+		n.logger.Debugw("rejected tx", "from", peerAddr(ctx), "hash", hash, "err", err)
+		return nil, err
+	}
+	n.logger.Infow("received tx", "from", peerAddr(ctx), "hash", hash, "we", n.ListenAddr)
 
-	if n.mempool.Add(tx) {
-		n.logger.Infof("received tx", "from", peer.Addr, "hash", hash, "we", n.ListenAddr)
+	go func() {
+		if err := n.broadcast(tx); err != nil {
+			n.logger.Errorw("broadcast error", "err", err)
+		}
+	}()
 
-		go func() {
-			n.mempool.Add(tx)
-			if err := n.broadcast(tx); err != nil {
-				n.logger.Errorw("broadcast error", "err", err)
-			}
-		}()
+	return &proto.Ack{}, nil
+}
+
+func (n *Node) admitTransaction(tx *proto.Transaction) error {
+	hash := types.HashTransaction(tx)
+	if _, err := n.chain.GetTransaction(hash); err == nil {
+		return status.Errorf(codes.AlreadyExists, "transaction %x is already in the chain", hash)
+	}
+	if n.mempool.Has(tx) {
+		return status.Error(codes.AlreadyExists, ErrInMempool.Error())
+	}
+
+	fee, err := n.chain.MempoolTransactionFee(tx, n.mempool)
+	if err != nil {
+		if errors.Is(err, ErrUnknownOutput) || errors.Is(err, ErrOutputSpent) || errors.Is(err, ErrTimeLocked) {
+			return status.Error(codes.FailedPrecondition, err.Error())
+		}
+		return status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	err = n.mempool.Admit(tx, fee)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrInMempool):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrMempoolFull):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	default:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+}
+
+// HandleBlock appends a block received from a peer to the chain and gossips
+// it further. Blocks we already have are acknowledged and not relayed again,
+// which stops them from bouncing around the network forever.
+func (n *Node) HandleBlock(ctx context.Context, b *proto.Block) (*proto.Ack, error) {
+	hash := types.HashBlock(b)
+	if n.chain.HasBlock(hash) {
+		return &proto.Ack{}, nil
+	}
+
+	if err := n.chain.AddBlock(b); err != nil {
+		return nil, err
+	}
+	n.interruptSeal()
+	n.logger.Infow("received block", "from", peerAddr(ctx), "hash", hex.EncodeToString(hash), "height", b.Header.Height, "we", n.ListenAddr)
+	n.onBlock(b)
+
+	go func() {
+		if err := n.broadcast(b); err != nil {
+			n.logger.Errorw("broadcast error", "err", err)
+		}
+	}()
+
 	return &proto.Ack{}, nil
 }
 
+func (n *Node) GetBlock(ctx context.Context, q *proto.BlockQuery) (*proto.Block, error) {
+	if len(q.Hash) > 0 {
+		return n.chain.GetBlockByHash(q.Hash)
+	}
+	if q.Height < 0 {
+		return nil, fmt.Errorf("invalid height (%d)", q.Height)
+	}
+	return n.chain.GetBlockByHeight(int(q.Height))
+}
+
+func (n *Node) GetTransaction(ctx context.Context, q *proto.TxQuery) (*proto.Transaction, error) {
+	return n.chain.GetTransaction(q.Hash)
+}
+
+func (n *Node) GetBalance(ctx context.Context, req *proto.AddressRequest) (*proto.Balance, error) {
+	if len(req.Address) != crypto.AddressLen {
+		return nil, fmt.Errorf("invalid address length (%d)", len(req.Address))
+	}
+
+	balance, err := n.chain.GetBalance(crypto.AddressFromBytes(req.Address))
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.Balance{Amount: balance}, nil
+}
+
+func (n *Node) ListUnspent(ctx context.Context, req *proto.AddressRequest) (*proto.UnspentList, error) {
+	if len(req.Address) != crypto.AddressLen {
+		return nil, fmt.Errorf("invalid address length (%d)", len(req.Address))
+	}
+
+	addr := crypto.AddressFromBytes(req.Address)
+	utxos, err := n.chain.ListUnspent(addr)
+	if err != nil {
+		return nil, err
+	}
+	if req.IncludePending {
+		confirmed := utxos
+		utxos = n.mempool.Unspent(hex.EncodeToString(req.Address))
+		for _, utxo := range confirmed {
+			if !n.mempool.Spent(fmt.Sprintf("%s_%d", utxo.Hash, utxo.OutIndex)) {
+				utxos = append(utxos, utxo)
+			}
+		}
+	}
+
+	list := &proto.UnspentList{}
+	for _, utxo := range utxos {
+		hash, err := hex.DecodeString(utxo.Hash)
+		if err != nil {
+			return nil, err
+		}
+		list.Unspent = append(list.Unspent, &proto.Unspent{
+			TxHash:   hash,
+			OutIndex: uint32(utxo.OutIndex),
+			Amount:   utxo.Amount,
+			Address:  req.Address,
+		})
+	}
+
+	return list, nil
+}
+
+// broadcast sends msg to every peer, peers that already have it are fine.
+// A failing peer doesn't stop the others from getting it, the failures are
+// logged and returned together.
 func (n *Node) broadcast(msg any) error {
-	for peer := range n.peers {
+	errs := []error{}
+	for peer, version := range n.getPeers() {
+		var err error
 		switch v := msg.(type) {
 		case *proto.Transaction:
-			_, err := peer.HandleTransaction(context.Background(), v)
-			if err != nil {
-				return err
+			_, err = peer.HandleTransaction(context.Background(), v)
+			if status.Code(err) == codes.AlreadyExists {
+				err = nil
+			}
+		case *proto.Block:
+			_, err = peer.HandleBlock(context.Background(), v)
+		case *proto.Vote:
+			if v.Type == proto.VoteType_PRECOMMIT {
+				_, err = peer.HandlePrecommit(context.Background(), v)
+			} else {
+				_, err = peer.HandlePrevote(context.Background(), v)
 			}
 		}
-
+		if err != nil {
+			n.logger.Debugw("broadcast to peer failed", "remote", version.ListedAddr, "err", err)
+			errs = append(errs, fmt.Errorf("peer %s: %w", version.ListedAddr, err))
+		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 func (n *Node) HandShake(ctx context.Context, v *proto.Version) (*proto.Version, error) {
+	if chainID := n.chain.Genesis().ChainID; v.ChainID != chainID {
+		return nil, fmt.Errorf("peer %s is on chain %q, expected %q", v.ListedAddr, v.ChainID, chainID)
+	}
 	c, err := makeNodeClient(v.ListedAddr)
 
 	if err != nil {
@@ -179,12 +698,20 @@ func (n *Node) HandShake(ctx context.Context, v *proto.Version) (*proto.Version,
 	return n.getVersion(), nil
 }
 
+// GetVersion tells clients which network the node is on and how far its
+// chain is, unlike HandShake it doesn't register the caller as a peer.
+func (n *Node) GetVersion(ctx context.Context, _ *proto.Ack) (*proto.Version, error) {
+	return n.getVersion(), nil
+}
+
 func (n *Node) getVersion() *proto.Version {
 	return &proto.Version{
-		Version:    "blocker-0.1",
-		Height:     0,
-		ListedAddr: n.ListenAddr,
-		PeerList:   n.getPeerList(),
+		Version:         "blocker-0.1",
+		Height:          int32(n.chain.Height()),
+		FinalizedHeight: int32(n.chain.FinalizedHeight()),
+		ListedAddr:      n.ListenAddr,
+		PeerList:        n.getPeerList(),
+		ChainID:         n.chain.Genesis().ChainID,
 	}
 }
 
@@ -215,6 +742,27 @@ func (n *Node) getPeerList() []string {
 	return peers
 }
 
+// getPeers returns a copy of the peers with the version they reported.
+func (n *Node) getPeers() map[proto.NodeClient]*proto.Version {
+	n.peerLock.RLock()
+	defer n.peerLock.RUnlock()
+
+	peers := make(map[proto.NodeClient]*proto.Version, len(n.peers))
+	for c, v := range n.peers {
+		peers[c] = v
+	}
+
+	return peers
+}
+
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return p.Addr.String()
+}
+
 func makeNodeClient(listenAddr string) (proto.NodeClient, error) {
 	c, err := grpc.Dial(listenAddr, grpc.WithInsecure())
 
@@ -238,6 +786,76 @@ func (n *Node) addPeer(c proto.NodeClient, v *proto.Version) {
 		go n.bootstrapNetwork(v.PeerList)
 	}
 	n.logger.Infof("we[%s] new peer connected remote(%s) -height (%d)", n.ListenAddr, v.ListedAddr, v.Height)
+
+	if int(v.Height) > n.chain.Height() {
+		go func() {
+			if err := n.syncBlocks(c); err != nil {
+				n.logger.Errorw("sync error", "remote", v.ListedAddr, "err", err)
+			}
+		}()
+	}
+}
+
+// syncBlocks downloads every block the peer has above our tip and applies
+// them in order.
+func (n *Node) syncBlocks(c proto.NodeClient) error {
+	n.syncLock.Lock()
+	defer n.syncLock.Unlock()
+
+	req := &proto.BlockRequest{
+		Locator: n.chain.Locator(),
+	}
+	stream, err := c.GetBlocks(context.Background(), req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		b, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if n.chain.HasBlock(types.HashBlock(b)) {
+			continue
+		}
+		if err := n.chain.AddBlock(b); err != nil {
+			return err
+		}
+		n.interruptSeal()
+		n.onBlock(b)
+	}
+	n.syncCommits(c)
+	n.logger.Infow("synced blocks", "we", n.ListenAddr, "height", n.chain.Height())
+
+	return nil
+}
+
+func (n *Node) GetBlocks(req *proto.BlockRequest, stream proto.Node_GetBlocksServer) error {
+	to := int(req.ToHeight)
+	if to == 0 || to > n.chain.Height() {
+		to = n.chain.Height()
+	}
+
+	from := max(int(req.FromHeight), 0)
+	if len(req.Locator) > 0 {
+		from = n.chain.FindFork(req.Locator) + 1
+	}
+
+	for height := from; height <= to; height++ {
+		b, err := n.chain.GetBlockByHeight(height)
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (n *Node) deletePeer(c proto.NodeClient) {
@@ -257,5 +875,8 @@ func (n *Node) dialRemote(addr string) (proto.NodeClient, *proto.Version, error)
 		n.logger.Errorf("handshake error", err)
 		return nil, nil, err
 	}
+	if chainID := n.chain.Genesis().ChainID; v.ChainID != chainID {
+		return nil, nil, fmt.Errorf("peer %s is on chain %q, expected %q", addr, v.ChainID, chainID)
+	}
 	return c, v, nil
 }
@@ -0,0 +1,577 @@
+package node
+
+import (
+	"context"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	"github.com/wvalencia19/blocker/util"
+	"github.com/wvalencia19/blocker/wallet"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// makeNode starts a node of the development network with a slot time short
+// enough for tests to produce blocks back to back.
+func makeNode(t *testing.T, privKey *crypto.PrivateKey) *Node {
+	g := DefaultGenesis()
+	g.BlockTime = Duration{time.Microsecond}
+	return makeNodeWithGenesis(t, g, privKey)
+}
+
+func makeNodeWithGenesis(t *testing.T, g *Genesis, privKey *crypto.PrivateKey) *Node {
+	genesisFile := filepath.Join(t.TempDir(), "genesis.json")
+	require.Nil(t, g.Save(genesisFile))
+
+	n, err := NewNode(ServerConfig{
+		Version:     "blocker-test",
+		PrivateKey:  privKey,
+		GenesisFile: genesisFile,
+	})
+	require.Nil(t, err)
+	return n
+}
+
+func makeValidator(t *testing.T) *Node {
+	return makeNode(t, crypto.NewPrivateKeyFromSeedStr(godSeed))
+}
+
+func TestProduceBlock(t *testing.T) {
+	n := makeValidator(t)
+	privKey := crypto.NewPrivateKeyFromSeedStr(godSeed)
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	prevTx := genesis.Transactions[0]
+
+	tx := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash:   types.HashTransaction(prevTx),
+				PrevOutIndex: 0,
+				PublicKey:    privKey.Public().Bytes(),
+			},
+		},
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  1000,
+				Address: crypto.GeneratePrivatekey().Public().Address().Bytes(),
+			},
+		},
+	}
+	types.SignTransactionInput(privKey, tx, 0, 1000)
+
+	junk := &proto.Transaction{
+		Version: 1,
+		ChainID: DevChainID,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: util.RandomHash(),
+				PublicKey:  privKey.Public().Bytes(),
+			},
+		},
+	}
+
+	n.mempool.Add(tx, 0)
+	n.mempool.Add(junk, 0)
+	require.Nil(t, n.produceBlock())
+
+	assert.Equal(t, 1, n.chain.Height())
+	assert.Equal(t, 0, n.mempool.Len())
+
+	block, err := n.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Equal(t, int32(1), block.Header.Height)
+	assert.Equal(t, n.PrivateKey.Public().Bytes(), block.PublicKey)
+	require.Len(t, block.Transactions, 2)
+	assert.True(t, types.IsCoinbase(block.Transactions[0]))
+	assert.Equal(t, types.HashTransaction(tx), types.HashTransaction(block.Transactions[1]))
+
+	require.Nil(t, n.produceBlock())
+	assert.Equal(t, 2, n.chain.Height())
+}
+
+func TestHandleBlock(t *testing.T) {
+	validator := makeValidator(t)
+	n := makeNode(t, nil)
+
+	tx := genesisSpend(t, validator.chain)
+	validator.mempool.Add(tx, 0)
+	n.mempool.Add(tx, 0)
+	require.Nil(t, validator.produceBlock())
+
+	block, err := validator.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+
+	_, err = n.HandleBlock(context.Background(), block)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n.chain.Height())
+	assert.False(t, n.mempool.Has(tx))
+
+	// receiving the same block again is a no-op
+	_, err = n.HandleBlock(context.Background(), block)
+	require.Nil(t, err)
+	assert.Equal(t, 1, n.chain.Height())
+
+	invalid := RandomBlock(t, n.chain)
+	invalid.Signature = util.RandomHash()
+	_, err = n.HandleBlock(context.Background(), invalid)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n.chain.Height())
+}
+
+func TestSyncBlocks(t *testing.T) {
+	validator := makeValidator(t)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, validator.produceBlock())
+	}
+
+	c := serveNode(t, validator)
+
+	n := makeNode(t, nil)
+	require.Nil(t, n.syncBlocks(c))
+	assert.Equal(t, 5, n.chain.Height())
+
+	for i := 0; i <= 5; i++ {
+		want, err := validator.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		got, err := n.chain.GetBlockByHeight(i)
+		require.Nil(t, err)
+		assert.Equal(t, types.HashBlock(want), types.HashBlock(got))
+	}
+
+	// nothing left to download once we are at the tip
+	require.Nil(t, n.syncBlocks(c))
+	assert.Equal(t, 5, n.chain.Height())
+}
+
+func serveNode(t *testing.T, n *Node) proto.NodeClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := grpc.NewServer()
+	proto.RegisterNodeServer(server, n)
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	c, err := makeNodeClient(ln.Addr().String())
+	require.Nil(t, err)
+	return c
+}
+
+func TestWalletSendOverRPC(t *testing.T) {
+	validator := makeValidator(t)
+	c := serveNode(t, validator)
+	ctx := context.Background()
+
+	w := wallet.New(wallet.NewNodeBackend(c), crypto.NewPrivateKeyFromSeedStr(godSeed))
+	alice := crypto.GeneratePrivatekey().Public().Address()
+
+	balance, err := w.Balance(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000), balance)
+
+	_, err = w.Send(ctx, alice, 250, 5)
+	require.Nil(t, err)
+	assert.Equal(t, 1, validator.mempool.Len())
+	require.Nil(t, validator.produceBlock())
+
+	// the validator collects the fee it paid along with the subsidy
+	balance, err = w.Balance(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1000-250-5+defaultSubsidy+5), balance)
+
+	aliceBalance, err := c.GetBalance(ctx, &proto.AddressRequest{Address: alice.Bytes()})
+	require.Nil(t, err)
+	assert.Equal(t, int64(250), aliceBalance.Amount)
+
+	list, err := c.ListUnspent(ctx, &proto.AddressRequest{Address: alice.Bytes()})
+	require.Nil(t, err)
+	require.Len(t, list.Unspent, 1)
+	assert.Equal(t, int64(250), list.Unspent[0].Amount)
+
+	_, err = c.GetBalance(ctx, &proto.AddressRequest{Address: []byte{1, 2}})
+	assert.NotNil(t, err)
+}
+
+func TestWalletBumpFee(t *testing.T) {
+	validator := makeValidator(t)
+	c := serveNode(t, validator)
+	ctx := context.Background()
+
+	w := wallet.New(wallet.NewNodeBackend(c), crypto.NewPrivateKeyFromSeedStr(godSeed))
+	alice := crypto.GeneratePrivatekey().Public().Address()
+
+	_, err := w.Send(ctx, alice, 250, 1)
+	require.Nil(t, err)
+	_, err = w.Send(ctx, alice, 250, 5)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	validator.mempool.Clear()
+
+	w.Replaceable = true
+	stuck, err := w.Send(ctx, alice, 250, 1)
+	require.Nil(t, err)
+	_, err = w.Send(ctx, alice, 250, 1)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	bumped, err := w.Send(ctx, alice, 250, 5)
+	require.Nil(t, err)
+	assert.False(t, validator.mempool.Has(stuck))
+	assert.True(t, validator.mempool.Has(bumped))
+
+	require.Nil(t, validator.produceBlock())
+	balance, err := c.GetBalance(ctx, &proto.AddressRequest{Address: alice.Bytes()})
+	require.Nil(t, err)
+	assert.Equal(t, int64(250), balance.Amount)
+}
+
+func TestWalletSpendsPendingChange(t *testing.T) {
+	validator := makeValidator(t)
+	c := serveNode(t, validator)
+	ctx := context.Background()
+
+	backend := wallet.NewNodeBackend(c)
+	w := wallet.New(backend, crypto.NewPrivateKeyFromSeedStr(godSeed))
+	alice := crypto.GeneratePrivatekey().Public().Address()
+
+	first, err := w.Send(ctx, alice, 250, 5)
+	require.Nil(t, err)
+	_, err = w.Send(ctx, alice, 100, 5)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "the only confirmed output is spent")
+
+	backend.IncludePending = true
+	balance, err := w.Balance(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, int64(745), balance)
+	second, err := w.Send(ctx, alice, 100, 5)
+	require.Nil(t, err)
+	assert.Equal(t, types.HashTransaction(first), second.Inputs[0].PrevTxHash)
+
+	require.Nil(t, validator.produceBlock())
+	block := mustTip(t, validator.chain)
+	require.Len(t, block.Transactions, 3)
+	assert.Equal(t, types.HashTransaction(first), types.HashTransaction(block.Transactions[1]))
+	assert.Equal(t, types.HashTransaction(second), types.HashTransaction(block.Transactions[2]))
+	assert.Equal(t, 0, validator.mempool.Len())
+
+	aliceBalance, err := c.GetBalance(ctx, &proto.AddressRequest{Address: alice.Bytes()})
+	require.Nil(t, err)
+	assert.Equal(t, int64(350), aliceBalance.Amount)
+}
+
+func TestGetBlockAndTransaction(t *testing.T) {
+	validator := makeValidator(t)
+	c := serveNode(t, validator)
+	ctx := context.Background()
+
+	tx := genesisSpend(t, validator.chain)
+	validator.mempool.Add(tx, 0)
+	require.Nil(t, validator.produceBlock())
+	tip, err := validator.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+
+	byHeight, err := c.GetBlock(ctx, &proto.BlockQuery{Height: 1})
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(tip), types.HashBlock(byHeight))
+	byHash, err := c.GetBlock(ctx, &proto.BlockQuery{Hash: types.HashBlock(tip)})
+	require.Nil(t, err)
+	assert.Equal(t, types.HashBlock(tip), types.HashBlock(byHash))
+
+	fetched, err := c.GetTransaction(ctx, &proto.TxQuery{Hash: types.HashTransaction(tx)})
+	require.Nil(t, err)
+	assert.Equal(t, types.HashTransaction(tx), types.HashTransaction(fetched))
+
+	_, err = c.GetBlock(ctx, &proto.BlockQuery{Height: 5})
+	assert.NotNil(t, err)
+	_, err = c.GetTransaction(ctx, &proto.TxQuery{Hash: []byte{1, 2}})
+	assert.NotNil(t, err)
+}
+
+func TestHandShakeForeignChain(t *testing.T) {
+	c := serveNode(t, makeNode(t, nil))
+	ctx := context.Background()
+
+	v, err := c.GetVersion(ctx, &proto.Ack{})
+	require.Nil(t, err)
+	assert.Equal(t, DevChainID, v.ChainID)
+
+	_, err = c.HandShake(ctx, &proto.Version{Version: "blocker-test", ListedAddr: ":0", ChainID: "other-net"})
+	assert.NotNil(t, err)
+
+	_, err = c.HandleTransaction(ctx, &proto.Transaction{Version: 1, ChainID: "other-net"})
+	assert.NotNil(t, err)
+}
+
+func TestNewNodeRejectsUnknownValidator(t *testing.T) {
+	_, err := NewNode(ServerConfig{
+		Version:    "blocker-test",
+		PrivateKey: crypto.GeneratePrivatekey(),
+	})
+	assert.NotNil(t, err)
+}
+
+func TestProduceBlockPoW(t *testing.T) {
+	g := DefaultGenesis()
+	g.Engine = EnginePoW
+	g.Difficulty = 6
+	g.Validators = nil
+	miner := makeNodeWithGenesis(t, g, crypto.GeneratePrivatekey())
+	n := makeNodeWithGenesis(t, g, nil)
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, miner.produceBlock())
+	}
+	require.Nil(t, n.syncBlocks(serveNode(t, miner)))
+	assert.Equal(t, 3, n.chain.Height())
+
+	// a block that doesn't meet the target is rejected
+	tip := mustTip(t, n.chain)
+	b := childBlock(t, tip)
+	b.Header.Timestamp = tip.Header.Timestamp + 1
+	b.Header.Bits = tip.Header.Bits
+	types.SignBlock(crypto.GeneratePrivatekey(), b)
+	for n.chain.Consensus().VerifyHeader(n.chain, tip.Header, b, time.Now()) == nil {
+		b.Header.Nonce++
+		types.SignBlock(crypto.GeneratePrivatekey(), b)
+	}
+	_, err := n.HandleBlock(context.Background(), b)
+	assert.ErrorContains(t, err, "target")
+	assert.Equal(t, 3, n.chain.Height())
+}
+
+func TestProduceBlockSkipsDoubleSpends(t *testing.T) {
+	n := makeValidator(t)
+	first := genesisSpend(t, n.chain)
+	second := genesisSpend(t, n.chain)
+	require.NotEqual(t, types.HashTransaction(first), types.HashTransaction(second))
+	require.True(t, n.mempool.Add(first, 0))
+	assert.False(t, n.mempool.Add(second, 0))
+
+	require.Nil(t, n.produceBlock())
+	block, err := n.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Len(t, block.Transactions, 2)
+	assert.Equal(t, 0, n.mempool.Len())
+}
+
+func TestHandleTransactionAdmission(t *testing.T) {
+	validator := makeValidator(t)
+	c := serveNode(t, validator)
+	ctx := context.Background()
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+
+	tx := genesisSpend(t, validator.chain)
+	_, err := c.HandleTransaction(ctx, tx)
+	require.Nil(t, err)
+	assert.Equal(t, 1, validator.mempool.Len())
+
+	tampered := genesisSpend(t, validator.chain)
+	tampered.Outputs[0].Amount = 999
+	unknown := genesisSpend(t, validator.chain)
+	unknown.Inputs[0].PrevTxHash = util.RandomHash()
+	types.SignTransactionInput(god, unknown, 0, 1000)
+	foreign := genesisSpend(t, validator.chain)
+	foreign.ChainID = "other-net"
+	types.SignTransactionInput(god, foreign, 0, 1000)
+	locked := genesisSpend(t, validator.chain)
+	locked.LockTime = 5
+	types.SignTransactionInput(god, locked, 0, 1000)
+
+	tests := []struct {
+		name string
+		tx   *proto.Transaction
+		code codes.Code
+	}{
+		{"duplicate", tx, codes.AlreadyExists},
+		{"conflicting spend", genesisSpend(t, validator.chain), codes.FailedPrecondition},
+		{"unknown output", unknown, codes.FailedPrecondition},
+		{"time locked", locked, codes.FailedPrecondition},
+		{"invalid signature", tampered, codes.InvalidArgument},
+		{"foreign chain", foreign, codes.InvalidArgument},
+		{"coinbase", validator.chain.Genesis().Coinbase(1, god.Public().Address(), 0), codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.HandleTransaction(ctx, tt.tx)
+			assert.Equal(t, tt.code, status.Code(err), err)
+		})
+	}
+	assert.Equal(t, 1, validator.mempool.Len())
+
+	// once in a block the transaction is known and its input spent
+	require.Nil(t, validator.produceBlock())
+	_, err = c.HandleTransaction(ctx, tx)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = c.HandleTransaction(ctx, genesisSpend(t, validator.chain))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestMempoolSurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	genesisFile := filepath.Join(t.TempDir(), "genesis.json")
+	g := DefaultGenesis()
+	g.BlockTime = Duration{time.Microsecond}
+	require.Nil(t, g.Save(genesisFile))
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	start := func() *Node {
+		n, err := NewNode(ServerConfig{
+			Version:     "blocker-test",
+			PrivateKey:  god,
+			DataDir:     dataDir,
+			GenesisFile: genesisFile,
+		})
+		require.Nil(t, err)
+		require.Nil(t, n.loadMempool())
+		return n
+	}
+	pay := func(amount int64) *proto.TxOutput {
+		return &proto.TxOutput{Amount: amount, Address: god.Public().Address().Bytes()}
+	}
+
+	n := start()
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	parent := signedSpend(t, god, genesis.Transactions[0], []uint32{0}, pay(990))
+	child := signedSpend(t, god, parent, []uint32{0}, pay(980))
+	require.Nil(t, n.admitTransaction(parent))
+	require.Nil(t, n.admitTransaction(child))
+	require.Nil(t, n.Stop())
+
+	n = start()
+	assert.Equal(t, hashes([]*proto.Transaction{parent, child}), hashes(n.mempool.Select(maxBlockTxBytes)))
+
+	// a block double spending the parent while the node was down makes both
+	// invalid by the next start
+	require.Nil(t, n.Stop())
+	saved, err := os.ReadFile(filepath.Join(dataDir, "mempool.dat"))
+	require.Nil(t, err)
+	n = start()
+	n.mempool.Clear()
+	require.Nil(t, n.admitTransaction(signedSpend(t, god, genesis.Transactions[0], []uint32{0}, pay(1000))))
+	require.Nil(t, n.produceBlock())
+	require.Nil(t, n.Stop())
+	require.Nil(t, os.WriteFile(filepath.Join(dataDir, "mempool.dat"), saved, 0600))
+
+	n = start()
+	assert.Equal(t, 0, n.mempool.Len())
+	assert.Equal(t, 1, n.chain.Height())
+	require.Nil(t, n.Stop())
+}
+
+func TestFailedStartKeepsMempool(t *testing.T) {
+	dataDir := t.TempDir()
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	cfg := ServerConfig{Version: "blocker-test", DataDir: dataDir}
+	n, err := NewNode(cfg)
+	require.Nil(t, err)
+	require.Nil(t, n.loadMempool())
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	pay := &proto.TxOutput{Amount: 990, Address: god.Public().Address().Bytes()}
+	require.Nil(t, n.admitTransaction(signedSpend(t, god, genesis.Transactions[0], []uint32{0}, pay)))
+	require.Nil(t, n.Stop())
+	saved, err := os.ReadFile(filepath.Join(dataDir, "mempool.dat"))
+	require.Nil(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	n, err = NewNode(cfg)
+	require.Nil(t, err)
+	require.NotNil(t, n.Start(ln.Addr().String(), nil))
+	require.Nil(t, n.Stop())
+
+	kept, err := os.ReadFile(filepath.Join(dataDir, "mempool.dat"))
+	require.Nil(t, err)
+	assert.Equal(t, saved, kept)
+}
+
+// recordingPeer is a peer client remembering the transactions it is sent,
+// failing them all when err is set.
+type recordingPeer struct {
+	proto.NodeClient
+	err error
+	txx []*proto.Transaction
+}
+
+func (p *recordingPeer) HandleTransaction(ctx context.Context, tx *proto.Transaction, opts ...grpc.CallOption) (*proto.Ack, error) {
+	p.txx = append(p.txx, tx)
+	return &proto.Ack{}, p.err
+}
+
+func TestBroadcastReachesEveryPeer(t *testing.T) {
+	n := makeValidator(t)
+	peers := []*recordingPeer{{err: status.Error(codes.Unavailable, "down")}, {}, {err: status.Error(codes.AlreadyExists, "known")}, {err: status.Error(codes.Unavailable, "down")}}
+	for i, p := range peers {
+		n.addPeer(p, &proto.Version{ListedAddr: string(rune('a' + i))})
+	}
+
+	tx := genesisSpend(t, n.chain)
+	err := n.broadcast(tx)
+	assert.ErrorContains(t, err, "peer a")
+	assert.ErrorContains(t, err, "peer d")
+	assert.NotContains(t, err.Error(), "peer c")
+	for _, p := range peers {
+		assert.Len(t, p.txx, 1)
+	}
+}
+
+func TestProduceBlockFeeOverflow(t *testing.T) {
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	g := DefaultGenesis()
+	g.BlockTime = Duration{time.Microsecond}
+	g.Alloc[0].Amount = math.MaxInt64
+	n := makeNodeWithGenesis(t, g, god)
+
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	// the fee alone fits, the subsidy on top of it doesn't
+	tx := signedSpend(t, god, genesis.Transactions[0], []uint32{0}, &proto.TxOutput{Amount: 1, Address: god.Public().Address().Bytes()})
+	require.Nil(t, n.admitTransaction(tx))
+
+	require.Nil(t, n.produceBlock())
+	b, err := n.chain.GetBlockByHeight(1)
+	require.Nil(t, err)
+	assert.Len(t, b.Transactions, 1)
+	assert.True(t, n.mempool.Has(tx), "waits for a later block")
+}
+
+func TestProduceBlockKeepsTimeLocked(t *testing.T) {
+	n := makeValidator(t)
+	god := crypto.NewPrivateKeyFromSeedStr(godSeed)
+	genesis, err := n.chain.GetBlockByHeight(0)
+	require.Nil(t, err)
+	pay := &proto.TxOutput{Amount: 1000, Address: god.Public().Address().Bytes()}
+
+	// admitted before a reorg took the chain below its lock time
+	locked := signedSpend(t, god, genesis.Transactions[0], []uint32{0}, pay)
+	locked.LockTime = 3
+	require.Nil(t, types.SignTransactionInputs(locked, []*crypto.PrivateKey{god}, []int64{1000}))
+	child := signedSpend(t, god, locked, []uint32{0}, pay)
+	require.True(t, n.mempool.Add(locked, 0))
+	require.True(t, n.mempool.Add(child, 0))
+
+	for height := 1; height <= 3; height++ {
+		require.Nil(t, n.produceBlock())
+		b, err := n.chain.GetBlockByHeight(height)
+		require.Nil(t, err)
+		if height < 3 {
+			assert.Len(t, b.Transactions, 1)
+			assert.Equal(t, 2, n.mempool.Len())
+		} else {
+			assert.Len(t, b.Transactions, 3)
+			assert.Equal(t, 0, n.mempool.Len())
+		}
+	}
+}
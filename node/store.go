@@ -2,6 +2,7 @@ package node
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -9,19 +10,29 @@ import (
 	"github.com/wvalencia19/blocker/types"
 )
 
+// ErrNoTip is returned by a block store that doesn't hold a chain yet.
+var ErrNoTip = errors.New("no tip stored")
+
 type UTXOStorer interface {
 	Put(*UTXO) error
 	Get(string) (*UTXO, error)
+	Delete(string) error
+	// ListUnspent returns the unspent outputs owned by the given
+	// hex encoded address.
+	ListUnspent(string) ([]*UTXO, error)
 }
 
 type MemoryUTXOStore struct {
 	lock sync.RWMutex
 	data map[string]*UTXO
+	// unspent indexes the keys of the unspent outputs by address
+	unspent map[string]map[string]struct{}
 }
 
 func NewMemoryUTXOStore() *MemoryUTXOStore {
 	return &MemoryUTXOStore{
-		data: make(map[string]*UTXO),
+		data:    make(map[string]*UTXO),
+		unspent: make(map[string]map[string]struct{}),
 	}
 }
 
@@ -45,12 +56,46 @@ func (s *MemoryUTXOStore) Put(utxo *UTXO) error {
 	key := fmt.Sprintf("%s_%d", utxo.Hash, utxo.OutIndex)
 
 	s.data[key] = utxo
+
+	if utxo.Spent {
+		delete(s.unspent[utxo.Address], key)
+		return nil
+	}
+	if _, ok := s.unspent[utxo.Address]; !ok {
+		s.unspent[utxo.Address] = make(map[string]struct{})
+	}
+	s.unspent[utxo.Address][key] = struct{}{}
 	return nil
 }
 
+func (s *MemoryUTXOStore) Delete(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if utxo, ok := s.data[hash]; ok {
+		delete(s.unspent[utxo.Address], hash)
+	}
+	delete(s.data, hash)
+	return nil
+}
+
+func (s *MemoryUTXOStore) ListUnspent(address string) ([]*UTXO, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	utxos := []*UTXO{}
+	for key := range s.unspent[address] {
+		utxos = append(utxos, s.data[key])
+	}
+
+	return utxos, nil
+}
+
+// TXStorer holds the transactions of the main chain.
 type TXStorer interface {
 	Put(*proto.Transaction) error
 	Get(string) (*proto.Transaction, error)
+	Delete(string) error
 }
 
 type MemoryTXStore struct {
@@ -86,25 +131,42 @@ func (s *MemoryTXStore) Put(tx *proto.Transaction) error {
 	return nil
 }
 
+func (s *MemoryTXStore) Delete(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.txx, hash)
+	return nil
+}
+
 type BlockStorer interface {
 	Put(*proto.Block) error
 	Get(string) (*proto.Block, error)
+	// Tip returns the hash of the last block of the main chain.
+	Tip() (string, error)
+	SetTip(string) error
+	// PutCommit stores the commit certificate of a final block next to it.
+	PutCommit(*proto.CommitCertificate) error
+	GetCommit(string) (*proto.CommitCertificate, error)
 }
 
 type MemoryBlockStore struct {
-	lock   sync.RWMutex
-	blocks map[string]*proto.Block
+	lock    sync.RWMutex
+	blocks  map[string]*proto.Block
+	commits map[string]*proto.CommitCertificate
+	tip     string
 }
 
 func NewMemoryBlockStore() *MemoryBlockStore {
 	return &MemoryBlockStore{
-		blocks: make(map[string]*proto.Block),
+		blocks:  make(map[string]*proto.Block),
+		commits: make(map[string]*proto.CommitCertificate),
 	}
 }
 
 func (s *MemoryBlockStore) Get(hash string) (*proto.Block, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
 	block, ok := s.blocks[hash]
 	if !ok {
@@ -115,10 +177,115 @@ func (s *MemoryBlockStore) Get(hash string) (*proto.Block, error) {
 }
 
 func (s *MemoryBlockStore) Put(b *proto.Block) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	hash := hex.EncodeToString(types.HashBlock(b))
 	s.blocks[hash] = b
 	return nil
 }
+
+func (s *MemoryBlockStore) Tip() (string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.tip == "" {
+		return "", ErrNoTip
+	}
+	return s.tip, nil
+}
+
+func (s *MemoryBlockStore) SetTip(hash string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tip = hash
+	return nil
+}
+
+func (s *MemoryBlockStore) PutCommit(cert *proto.CommitCertificate) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.commits[hex.EncodeToString(cert.BlockHash)] = cert
+	return nil
+}
+
+func (s *MemoryBlockStore) GetCommit(hash string) (*proto.CommitCertificate, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cert, ok := s.commits[hash]
+	if !ok {
+		return nil, fmt.Errorf("no commit certificate for block [%s]", hash)
+	}
+
+	return cert, nil
+}
+
+// storeUpdate holds the writes connecting or disconnecting a block makes to
+// the stores, so they can be applied all at once.
+type storeUpdate struct {
+	// block is stored when set.
+	block *proto.Block
+	txx   []*proto.Transaction
+	// deleted holds the hashes of the transactions to delete.
+	deleted []string
+	// utxos holds the outputs to store by key, nil for the ones to delete.
+	utxos map[string]*UTXO
+	tip   string
+}
+
+func newStoreUpdate() *storeUpdate {
+	return &storeUpdate{
+		utxos: make(map[string]*UTXO),
+	}
+}
+
+// utxo returns the output stored under key as the update leaves it.
+func (u *storeUpdate) utxo(store UTXOStorer, key string) (*UTXO, error) {
+	if utxo, ok := u.utxos[key]; ok {
+		if utxo == nil {
+			return nil, fmt.Errorf("could not find utxo with hash %s", key)
+		}
+		return utxo, nil
+	}
+	utxo, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	stored := *utxo
+	return &stored, nil
+}
+
+// applyUpdate writes u to the stores one by one, the stores of a chain not
+// sharing a database can't do better.
+func applyUpdate(bs BlockStorer, txStore TXStorer, utxoStore UTXOStorer, u *storeUpdate) error {
+	for _, hash := range u.deleted {
+		if err := txStore.Delete(hash); err != nil {
+			return err
+		}
+	}
+	for _, tx := range u.txx {
+		if err := txStore.Put(tx); err != nil {
+			return err
+		}
+	}
+	for key, utxo := range u.utxos {
+		var err error
+		if utxo == nil {
+			err = utxoStore.Delete(key)
+		} else {
+			err = utxoStore.Put(utxo)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if u.block != nil {
+		if err := bs.Put(u.block); err != nil {
+			return err
+		}
+	}
+	return bs.SetTip(u.tip)
+}
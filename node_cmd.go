@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/node"
+)
+
+func runNodeStart(args []string) error {
+	flags := flag.NewFlagSet("node start", flag.ExitOnError)
+	configPath := flags.String("config", "", "YAML config file, BLOCKER_* environment variables override it")
+	listen := flags.String("listen", "", "address to listen on")
+	peers := flags.String("peers", "", "comma separated list of nodes to bootstrap from")
+	validatorKey := flags.String("validator-key", "", "file holding the validator key, the node produces blocks when set")
+	dataDir := flags.String("data-dir", "", "directory the chain is stored in, kept in memory when empty")
+	genesis := flags.String("genesis", "", "genesis file of the network, the development network when empty")
+	flags.Parse(args)
+
+	cfg, err := node.LoadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	// flags given on the command line win over the config file and environment
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listen
+		case "peers":
+			cfg.BootstrapNodes = node.SplitList(*peers)
+		case "validator-key":
+			cfg.ValidatorKey = *validatorKey
+		case "data-dir":
+			cfg.DataDir = *dataDir
+		case "genesis":
+			cfg.GenesisFile = *genesis
+		}
+	})
+
+	serverCfg, err := cfg.ServerConfig("blocker-0.1")
+	if err != nil {
+		return err
+	}
+	n, err := node.NewNode(serverCfg)
+	if err != nil {
+		return err
+	}
+
+	// stop gracefully on ctrl-c so the mempool gets saved
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- n.Start(cfg.ListenAddr, cfg.BootstrapNodes)
+	}()
+
+	select {
+	case err := <-errc:
+		n.Stop()
+		return err
+	case <-ctx.Done():
+		return n.Stop()
+	}
+}
+
+func runKeyNew(args []string) error {
+	flags := flag.NewFlagSet("key new", flag.ExitOnError)
+	out := flags.String("out", "validator.key", "file to write the key to")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("%s already exists", *out)
+	}
+
+	pk := crypto.GeneratePrivatekey()
+	seed := hex.EncodeToString(pk.Bytes()[:crypto.SeedLen])
+	if err := os.WriteFile(*out, []byte(seed+"\n"), 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("public key: %s\n", hex.EncodeToString(pk.Public().Bytes()))
+	fmt.Printf("address:    %s\n", pk.Public().Address())
+	return nil
+}
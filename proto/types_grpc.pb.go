@@ -24,6 +24,16 @@ const _ = grpc.SupportPackageIsVersion7
 type NodeClient interface {
 	HandShake(ctx context.Context, in *Version, opts ...grpc.CallOption) (*Version, error)
 	HandleTransaction(ctx context.Context, in *Transaction, opts ...grpc.CallOption) (*Ack, error)
+	HandleBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Ack, error)
+	GetBlocks(ctx context.Context, in *BlockRequest, opts ...grpc.CallOption) (Node_GetBlocksClient, error)
+	GetBalance(ctx context.Context, in *AddressRequest, opts ...grpc.CallOption) (*Balance, error)
+	ListUnspent(ctx context.Context, in *AddressRequest, opts ...grpc.CallOption) (*UnspentList, error)
+	GetBlock(ctx context.Context, in *BlockQuery, opts ...grpc.CallOption) (*Block, error)
+	GetTransaction(ctx context.Context, in *TxQuery, opts ...grpc.CallOption) (*Transaction, error)
+	GetVersion(ctx context.Context, in *Ack, opts ...grpc.CallOption) (*Version, error)
+	HandlePrevote(ctx context.Context, in *Vote, opts ...grpc.CallOption) (*Ack, error)
+	HandlePrecommit(ctx context.Context, in *Vote, opts ...grpc.CallOption) (*Ack, error)
+	GetCommit(ctx context.Context, in *BlockQuery, opts ...grpc.CallOption) (*CommitCertificate, error)
 }
 
 type nodeClient struct {
@@ -52,12 +62,135 @@ func (c *nodeClient) HandleTransaction(ctx context.Context, in *Transaction, opt
 	return out, nil
 }
 
+func (c *nodeClient) HandleBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Ack, error) {
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, "/Node/HandleBlock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetBlocks(ctx context.Context, in *BlockRequest, opts ...grpc.CallOption) (Node_GetBlocksClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Node_ServiceDesc.Streams[0], "/Node/GetBlocks", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &nodeGetBlocksClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Node_GetBlocksClient interface {
+	Recv() (*Block, error)
+	grpc.ClientStream
+}
+
+type nodeGetBlocksClient struct {
+	grpc.ClientStream
+}
+
+func (x *nodeGetBlocksClient) Recv() (*Block, error) {
+	m := new(Block)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *nodeClient) GetBalance(ctx context.Context, in *AddressRequest, opts ...grpc.CallOption) (*Balance, error) {
+	out := new(Balance)
+	err := c.cc.Invoke(ctx, "/Node/GetBalance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) ListUnspent(ctx context.Context, in *AddressRequest, opts ...grpc.CallOption) (*UnspentList, error) {
+	out := new(UnspentList)
+	err := c.cc.Invoke(ctx, "/Node/ListUnspent", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetBlock(ctx context.Context, in *BlockQuery, opts ...grpc.CallOption) (*Block, error) {
+	out := new(Block)
+	err := c.cc.Invoke(ctx, "/Node/GetBlock", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetTransaction(ctx context.Context, in *TxQuery, opts ...grpc.CallOption) (*Transaction, error) {
+	out := new(Transaction)
+	err := c.cc.Invoke(ctx, "/Node/GetTransaction", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetVersion(ctx context.Context, in *Ack, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/Node/GetVersion", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) HandlePrevote(ctx context.Context, in *Vote, opts ...grpc.CallOption) (*Ack, error) {
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, "/Node/HandlePrevote", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) HandlePrecommit(ctx context.Context, in *Vote, opts ...grpc.CallOption) (*Ack, error) {
+	out := new(Ack)
+	err := c.cc.Invoke(ctx, "/Node/HandlePrecommit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *nodeClient) GetCommit(ctx context.Context, in *BlockQuery, opts ...grpc.CallOption) (*CommitCertificate, error) {
+	out := new(CommitCertificate)
+	err := c.cc.Invoke(ctx, "/Node/GetCommit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // NodeServer is the server API for Node service.
 // All implementations must embed UnimplementedNodeServer
 // for forward compatibility
 type NodeServer interface {
 	HandShake(context.Context, *Version) (*Version, error)
 	HandleTransaction(context.Context, *Transaction) (*Ack, error)
+	HandleBlock(context.Context, *Block) (*Ack, error)
+	GetBlocks(*BlockRequest, Node_GetBlocksServer) error
+	GetBalance(context.Context, *AddressRequest) (*Balance, error)
+	ListUnspent(context.Context, *AddressRequest) (*UnspentList, error)
+	GetBlock(context.Context, *BlockQuery) (*Block, error)
+	GetTransaction(context.Context, *TxQuery) (*Transaction, error)
+	GetVersion(context.Context, *Ack) (*Version, error)
+	HandlePrevote(context.Context, *Vote) (*Ack, error)
+	HandlePrecommit(context.Context, *Vote) (*Ack, error)
+	GetCommit(context.Context, *BlockQuery) (*CommitCertificate, error)
 	mustEmbedUnimplementedNodeServer()
 }
 
@@ -71,6 +204,36 @@ func (UnimplementedNodeServer) HandShake(context.Context, *Version) (*Version, e
 func (UnimplementedNodeServer) HandleTransaction(context.Context, *Transaction) (*Ack, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HandleTransaction not implemented")
 }
+func (UnimplementedNodeServer) HandleBlock(context.Context, *Block) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HandleBlock not implemented")
+}
+func (UnimplementedNodeServer) GetBlocks(*BlockRequest, Node_GetBlocksServer) error {
+	return status.Errorf(codes.Unimplemented, "method GetBlocks not implemented")
+}
+func (UnimplementedNodeServer) GetBalance(context.Context, *AddressRequest) (*Balance, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBalance not implemented")
+}
+func (UnimplementedNodeServer) ListUnspent(context.Context, *AddressRequest) (*UnspentList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUnspent not implemented")
+}
+func (UnimplementedNodeServer) GetBlock(context.Context, *BlockQuery) (*Block, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlock not implemented")
+}
+func (UnimplementedNodeServer) GetTransaction(context.Context, *TxQuery) (*Transaction, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTransaction not implemented")
+}
+func (UnimplementedNodeServer) GetVersion(context.Context, *Ack) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVersion not implemented")
+}
+func (UnimplementedNodeServer) HandlePrevote(context.Context, *Vote) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HandlePrevote not implemented")
+}
+func (UnimplementedNodeServer) HandlePrecommit(context.Context, *Vote) (*Ack, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HandlePrecommit not implemented")
+}
+func (UnimplementedNodeServer) GetCommit(context.Context, *BlockQuery) (*CommitCertificate, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCommit not implemented")
+}
 func (UnimplementedNodeServer) mustEmbedUnimplementedNodeServer() {}
 
 // UnsafeNodeServer may be embedded to opt out of forward compatibility for this service.
@@ -120,6 +283,189 @@ func _Node_HandleTransaction_Handler(srv interface{}, ctx context.Context, dec f
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Node_HandleBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Block)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).HandleBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/HandleBlock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).HandleBlock(ctx, req.(*Block))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetBlocks_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BlockRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(NodeServer).GetBlocks(m, &nodeGetBlocksServer{stream})
+}
+
+type Node_GetBlocksServer interface {
+	Send(*Block) error
+	grpc.ServerStream
+}
+
+type nodeGetBlocksServer struct {
+	grpc.ServerStream
+}
+
+func (x *nodeGetBlocksServer) Send(m *Block) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Node_GetBalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetBalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetBalance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetBalance(ctx, req.(*AddressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_ListUnspent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).ListUnspent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/ListUnspent",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).ListUnspent(ctx, req.(*AddressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetBlock",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetBlock(ctx, req.(*BlockQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetTransaction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetTransaction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetTransaction",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetTransaction(ctx, req.(*TxQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetVersion_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Ack)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetVersion(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetVersion",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetVersion(ctx, req.(*Ack))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_HandlePrevote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Vote)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).HandlePrevote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/HandlePrevote",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).HandlePrevote(ctx, req.(*Vote))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_HandlePrecommit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Vote)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).HandlePrecommit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/HandlePrecommit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).HandlePrecommit(ctx, req.(*Vote))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Node_GetCommit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(NodeServer).GetCommit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Node/GetCommit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(NodeServer).GetCommit(ctx, req.(*BlockQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Node_ServiceDesc is the grpc.ServiceDesc for Node service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -135,7 +481,49 @@ var Node_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HandleTransaction",
 			Handler:    _Node_HandleTransaction_Handler,
 		},
+		{
+			MethodName: "HandleBlock",
+			Handler:    _Node_HandleBlock_Handler,
+		},
+		{
+			MethodName: "GetBalance",
+			Handler:    _Node_GetBalance_Handler,
+		},
+		{
+			MethodName: "ListUnspent",
+			Handler:    _Node_ListUnspent_Handler,
+		},
+		{
+			MethodName: "GetBlock",
+			Handler:    _Node_GetBlock_Handler,
+		},
+		{
+			MethodName: "GetTransaction",
+			Handler:    _Node_GetTransaction_Handler,
+		},
+		{
+			MethodName: "GetVersion",
+			Handler:    _Node_GetVersion_Handler,
+		},
+		{
+			MethodName: "HandlePrevote",
+			Handler:    _Node_HandlePrevote_Handler,
+		},
+		{
+			MethodName: "HandlePrecommit",
+			Handler:    _Node_HandlePrecommit_Handler,
+		},
+		{
+			MethodName: "GetCommit",
+			Handler:    _Node_GetCommit_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "GetBlocks",
+			Handler:       _Node_GetBlocks_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/types.proto",
 }
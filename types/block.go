@@ -52,14 +52,24 @@ func VerifyBlock(b *proto.Block) bool {
 	return sig.Verify(pubKey, hash)
 }
 
-func SignBlock(pk *crypto.PrivateKey, b *proto.Block) *crypto.Signature {
-	if len(b.Transactions) > 0 {
-		tree, err := GetMerkleTree(b)
-		if err != nil {
-			panic(err)
-		}
+// SetRootHash commits the header to the transactions of the block, blocks
+// without transactions keep their root hash.
+func SetRootHash(b *proto.Block) error {
+	if len(b.Transactions) == 0 {
+		return nil
+	}
+
+	tree, err := GetMerkleTree(b)
+	if err != nil {
+		return err
+	}
+	b.Header.RootHash = tree.MerkleRoot()
+	return nil
+}
 
-		b.Header.RootHash = tree.MerkleRoot()
+func SignBlock(pk *crypto.PrivateKey, b *proto.Block) *crypto.Signature {
+	if err := SetRootHash(b); err != nil {
+		panic(err)
 	}
 	hash := HashBlock(b)
 	sig := pk.Sign(hash)
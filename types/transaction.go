@@ -2,14 +2,90 @@ package types
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
 
 	"github.com/wvalencia19/blocker/crypto"
 	"github.com/wvalencia19/blocker/proto"
 	pb "google.golang.org/protobuf/proto"
 )
 
-func SignTransaction(pk *crypto.PrivateKey, tx *proto.Transaction) *crypto.Signature {
-	return pk.Sign(HashTransaction(tx))
+// SigHash returns the digest signed by the input at index i, amount being the
+// value of the output it spends. It commits to the transaction with all the
+// signatures stripped plus the spent outpoint and amount, so inputs can be
+// signed in any order without invalidating each other.
+func SigHash(tx *proto.Transaction, i int, amount int64) []byte {
+	stripped := pb.Clone(tx).(*proto.Transaction)
+	for _, input := range stripped.Inputs {
+		input.Signature = nil
+	}
+
+	b, err := pb.MarshalOptions{Deterministic: true}.Marshal(stripped)
+	if err != nil {
+		panic(err)
+	}
+
+	input := tx.Inputs[i]
+	hash := sha256.New()
+	hash.Write(b)
+	binary.Write(hash, binary.BigEndian, uint32(i))
+	hash.Write(input.PrevTxHash)
+	binary.Write(hash, binary.BigEndian, input.PrevOutIndex)
+	binary.Write(hash, binary.BigEndian, amount)
+
+	return hash.Sum(nil)
+}
+
+// SignTransactionInput signs the input at index i and stores the signature
+// on it. The public keys are part of what gets signed, so every input needs
+// its public key set before any of them is signed.
+func SignTransactionInput(pk *crypto.PrivateKey, tx *proto.Transaction, i int, amount int64) *crypto.Signature {
+	sig := pk.Sign(SigHash(tx, i, amount))
+	tx.Inputs[i].Signature = sig.Bytes()
+
+	return sig
+}
+
+// SignTransactionInputs signs every input of the transaction, keys[i] and
+// amounts[i] being the key owning and the value of the output input i spends.
+func SignTransactionInputs(tx *proto.Transaction, keys []*crypto.PrivateKey, amounts []int64) error {
+	if len(keys) != len(tx.Inputs) || len(amounts) != len(tx.Inputs) {
+		return fmt.Errorf("got %d keys and %d amounts for %d inputs", len(keys), len(amounts), len(tx.Inputs))
+	}
+
+	for i, input := range tx.Inputs {
+		input.PublicKey = keys[i].Public().Bytes()
+	}
+	for i := range tx.Inputs {
+		SignTransactionInput(keys[i], tx, i, amounts[i])
+	}
+
+	return nil
+}
+
+const (
+	// LockTimeThreshold splits transaction lock times into block heights,
+	// below it, and unix times in seconds.
+	LockTimeThreshold = 500_000_000
+	// SequenceTimeFlag makes the relative lock of an input count seconds
+	// instead of blocks.
+	SequenceTimeFlag = 1 << 31
+)
+
+// IsCoinbase reports whether tx is a coinbase, the transaction without
+// inputs a block starts with to pay out its reward.
+func IsCoinbase(tx *proto.Transaction) bool {
+	return len(tx.Inputs) == 0
+}
+
+// AddAmount adds two non negative amounts, failing instead of wrapping
+// around.
+func AddAmount(a, b int64) (int64, error) {
+	if b > math.MaxInt64-a {
+		return 0, fmt.Errorf("amount overflow adding %d to %d", b, a)
+	}
+	return a + b, nil
 }
 
 func HashTransaction(tx *proto.Transaction) []byte {
@@ -23,22 +99,27 @@ func HashTransaction(tx *proto.Transaction) []byte {
 	return hash[:]
 }
 
-func VerifyTransaction(tx *proto.Transaction) bool {
-	for _, input := range tx.Inputs {
-		if len(input.Signature) == 0 {
-			panic("the transaction has no signature")
+// VerifyTransaction checks the signature of every input, amounts[i] being the
+// value of the output spent by input i. The transaction is left untouched.
+func VerifyTransaction(tx *proto.Transaction, amounts []int64) bool {
+	if len(amounts) != len(tx.Inputs) {
+		return false
+	}
+
+	for i, input := range tx.Inputs {
+		if len(input.Signature) != crypto.SignatureLen {
+			return false
+		}
+		if len(input.PublicKey) != crypto.PubKeyLen {
+			return false
 		}
 
 		sig := crypto.SignatureFromBytes(input.Signature)
 		pubKey := crypto.PublicKeyFromBytes(input.PublicKey)
 
-		// TODO: make sure we dont runt into problems after verification
-		// cause we have set the signature to nil.
-		input.Signature = nil
-		if !sig.Verify(pubKey, HashTransaction(tx)) {
+		if !sig.Verify(pubKey, SigHash(tx, i, amounts[i])) {
 			return false
 		}
-
 	}
 
 	return true
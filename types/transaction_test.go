@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/wvalencia19/blocker/crypto"
 	"github.com/wvalencia19/blocker/proto"
 	"github.com/wvalencia19/blocker/util"
@@ -44,8 +45,77 @@ func TestNewTransaction(t *testing.T) {
 		Outputs: []*proto.TxOutput{output1, output2},
 	}
 
-	sig := SignTransaction(fromPrivKey, tx)
-	input.Signature = sig.Bytes()
+	sig := SignTransactionInput(fromPrivKey, tx, 0, 100)
+	assert.Equal(t, sig.Bytes(), input.Signature)
 
-	assert.True(t, VerifyTransaction(tx))
+	assert.True(t, VerifyTransaction(tx, []int64{100}))
+	// the signature commits to the amount being spent
+	assert.False(t, VerifyTransaction(tx, []int64{1000}))
+}
+
+func TestSignTransactionInputs(t *testing.T) {
+	keys := []*crypto.PrivateKey{
+		crypto.GeneratePrivatekey(),
+		crypto.GeneratePrivatekey(),
+		crypto.GeneratePrivatekey(),
+	}
+	amounts := []int64{10, 20, 30}
+
+	tx := &proto.Transaction{
+		Version: 1,
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  60,
+				Address: crypto.GeneratePrivatekey().Public().Address().Bytes(),
+			},
+		},
+	}
+	for i := range keys {
+		tx.Inputs = append(tx.Inputs, &proto.TxInput{
+			PrevTxHash:   util.RandomHash(),
+			PrevOutIndex: uint32(i),
+		})
+	}
+
+	require.Nil(t, SignTransactionInputs(tx, keys, amounts))
+	hash := HashTransaction(tx)
+
+	assert.True(t, VerifyTransaction(tx, amounts))
+	// verifying leaves the tx untouched so it can be verified again
+	assert.Equal(t, hash, HashTransaction(tx))
+	assert.True(t, VerifyTransaction(tx, amounts))
+
+	for i, input := range tx.Inputs {
+		assert.Equal(t, keys[i].Public().Bytes(), input.PublicKey)
+	}
+
+	// signatures can't be moved between inputs
+	tx.Inputs[0].Signature, tx.Inputs[1].Signature = tx.Inputs[1].Signature, tx.Inputs[0].Signature
+	assert.False(t, VerifyTransaction(tx, amounts))
+	tx.Inputs[0].Signature, tx.Inputs[1].Signature = tx.Inputs[1].Signature, tx.Inputs[0].Signature
+
+	// the chain ID is signed so the tx can't be replayed on another network
+	tx.ChainID = "other-net"
+	assert.False(t, VerifyTransaction(tx, amounts))
+	tx.ChainID = ""
+
+	// changing an output invalidates every input
+	tx.Outputs[0].Amount = 61
+	assert.False(t, VerifyTransaction(tx, amounts))
+
+	assert.NotNil(t, SignTransactionInputs(tx, keys[:2], amounts))
+	assert.False(t, VerifyTransaction(tx, amounts[:2]))
+}
+
+func TestVerifyTransactionWithoutSignature(t *testing.T) {
+	tx := &proto.Transaction{
+		Version: 1,
+		Inputs: []*proto.TxInput{
+			{
+				PrevTxHash: util.RandomHash(),
+				PublicKey:  crypto.GeneratePrivatekey().Public().Bytes(),
+			},
+		},
+	}
+	assert.False(t, VerifyTransaction(tx, []int64{100}))
 }
@@ -0,0 +1,45 @@
+package types
+
+import (
+	"crypto/sha256"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// HashVote returns the digest a validator signs, the vote without its
+// signature.
+func HashVote(v *proto.Vote) []byte {
+	stripped := pb.Clone(v).(*proto.Vote)
+	stripped.Signature = nil
+
+	b, err := pb.MarshalOptions{Deterministic: true}.Marshal(stripped)
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(b)
+
+	return hash[:]
+}
+
+func SignVote(pk *crypto.PrivateKey, v *proto.Vote) *crypto.Signature {
+	v.PublicKey = pk.Public().Bytes()
+	sig := pk.Sign(HashVote(v))
+	v.Signature = sig.Bytes()
+
+	return sig
+}
+
+func VerifyVote(v *proto.Vote) bool {
+	if len(v.PublicKey) != crypto.PubKeyLen {
+		return false
+	}
+	if len(v.Signature) != crypto.SignatureLen {
+		return false
+	}
+
+	sig := crypto.SignatureFromBytes(v.Signature)
+	pubKey := crypto.PublicKeyFromBytes(v.PublicKey)
+	return sig.Verify(pubKey, HashVote(v))
+}
@@ -0,0 +1,32 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/util"
+)
+
+func TestSignVerifyVote(t *testing.T) {
+	privKey := crypto.GeneratePrivatekey()
+	vote := &proto.Vote{
+		Type:      proto.VoteType_PRECOMMIT,
+		Height:    3,
+		Round:     1,
+		BlockHash: util.RandomHash(),
+		ChainID:   "test",
+	}
+
+	SignVote(privKey, vote)
+	assert.Equal(t, privKey.Public().Bytes(), vote.PublicKey)
+	assert.True(t, VerifyVote(vote))
+
+	vote.Round = 2
+	assert.False(t, VerifyVote(vote))
+
+	vote.Round = 1
+	vote.PublicKey = crypto.GeneratePrivatekey().Public().Bytes()
+	assert.False(t, VerifyVote(vote))
+}
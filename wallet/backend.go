@@ -0,0 +1,56 @@
+package wallet
+
+import (
+	"context"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+)
+
+// NodeBackend is a Backend talking to a node over gRPC.
+type NodeBackend struct {
+	client proto.NodeClient
+	// IncludePending makes the wallet spend the outputs of transactions
+	// still waiting in the mempool of the node, like the change of a
+	// payment just sent.
+	IncludePending bool
+}
+
+func NewNodeBackend(client proto.NodeClient) *NodeBackend {
+	return &NodeBackend{
+		client: client,
+	}
+}
+
+func (b *NodeBackend) ListUnspent(ctx context.Context, addr crypto.Address) ([]*Unspent, error) {
+	list, err := b.client.ListUnspent(ctx, &proto.AddressRequest{Address: addr.Bytes(), IncludePending: b.IncludePending})
+	if err != nil {
+		return nil, err
+	}
+
+	utxos := make([]*Unspent, len(list.Unspent))
+	for i, utxo := range list.Unspent {
+		utxos[i] = &Unspent{
+			TxHash:   utxo.TxHash,
+			OutIndex: utxo.OutIndex,
+			Amount:   utxo.Amount,
+			Address:  addr,
+		}
+	}
+
+	return utxos, nil
+}
+
+func (b *NodeBackend) ChainID(ctx context.Context) (string, error) {
+	v, err := b.client.GetVersion(ctx, &proto.Ack{})
+	if err != nil {
+		return "", err
+	}
+
+	return v.ChainID, nil
+}
+
+func (b *NodeBackend) SubmitTransaction(ctx context.Context, tx *proto.Transaction) error {
+	_, err := b.client.HandleTransaction(ctx, tx)
+	return err
+}
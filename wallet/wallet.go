@@ -0,0 +1,267 @@
+package wallet
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+)
+
+// Unspent is an output owned by one of the wallet addresses.
+type Unspent struct {
+	TxHash   []byte
+	OutIndex uint32
+	Amount   int64
+	Address  crypto.Address
+}
+
+// Backend is the node the wallet looks its funds up on and sends its
+// transactions to.
+type Backend interface {
+	ListUnspent(ctx context.Context, addr crypto.Address) ([]*Unspent, error)
+	// ChainID identifies the network transactions are signed for.
+	ChainID(ctx context.Context) (string, error)
+	SubmitTransaction(ctx context.Context, tx *proto.Transaction) error
+}
+
+type Wallet struct {
+	backend Backend
+	keys    []*crypto.PrivateKey
+	// Replaceable marks the transactions the wallet builds as replaceable,
+	// sending the same payment again with a higher fee then replaces the
+	// one stuck in the mempool.
+	Replaceable bool
+}
+
+// New creates a wallet holding the given keys, the first one receives the
+// change of every transaction.
+func New(backend Backend, keys ...*crypto.PrivateKey) *Wallet {
+	return &Wallet{
+		backend: backend,
+		keys:    keys,
+	}
+}
+
+// NewKey generates a new key, adds it to the wallet and returns its address.
+func (w *Wallet) NewKey() crypto.Address {
+	pk := crypto.GeneratePrivatekey()
+	w.keys = append(w.keys, pk)
+
+	return pk.Public().Address()
+}
+
+func (w *Wallet) Addresses() []crypto.Address {
+	addrs := make([]crypto.Address, len(w.keys))
+	for i, pk := range w.keys {
+		addrs[i] = pk.Public().Address()
+	}
+	return addrs
+}
+
+func (w *Wallet) keyFor(addr crypto.Address) (*crypto.PrivateKey, bool) {
+	for _, pk := range w.keys {
+		if pk.Public().Address().String() == addr.String() {
+			return pk, true
+		}
+	}
+	return nil, false
+}
+
+// Unspent returns the outputs spendable by any of the wallet addresses.
+func (w *Wallet) Unspent(ctx context.Context) ([]*Unspent, error) {
+	utxos := []*Unspent{}
+
+	for _, addr := range w.Addresses() {
+		unspent, err := w.backend.ListUnspent(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		utxos = append(utxos, unspent...)
+	}
+
+	return utxos, nil
+}
+
+func (w *Wallet) Balance(ctx context.Context) (int64, error) {
+	utxos, err := w.Unspent(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	balance := int64(0)
+	for _, utxo := range utxos {
+		if balance, err = types.AddAmount(balance, utxo.Amount); err != nil {
+			return 0, fmt.Errorf("balance: %w", err)
+		}
+	}
+
+	return balance, nil
+}
+
+// SelectCoins picks outputs, biggest first, until they cover target. It
+// returns the selected outputs and how much they hold.
+func SelectCoins(utxos []*Unspent, target int64) ([]*Unspent, int64, error) {
+	sorted := make([]*Unspent, len(utxos))
+	copy(sorted, utxos)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Amount > sorted[j].Amount
+	})
+
+	selected := []*Unspent{}
+	total := int64(0)
+	var err error
+	for _, utxo := range sorted {
+		if total >= target {
+			break
+		}
+		if total, err = types.AddAmount(total, utxo.Amount); err != nil {
+			return nil, 0, fmt.Errorf("selecting coins: %w", err)
+		}
+		selected = append(selected, utxo)
+	}
+
+	if total < target {
+		return nil, 0, fmt.Errorf("insufficient funds got (%d) need (%d)", total, target)
+	}
+
+	return selected, total, nil
+}
+
+// BuildTransaction creates a signed transaction paying amount to the given
+// address. Whatever the selected outputs hold above amount and fee is sent
+// back to the first wallet address.
+func (w *Wallet) BuildTransaction(ctx context.Context, to crypto.Address, amount, fee int64) (*proto.Transaction, error) {
+	if len(w.keys) == 0 {
+		return nil, fmt.Errorf("wallet has no keys")
+	}
+	if amount <= 0 {
+		return nil, fmt.Errorf("invalid amount (%d)", amount)
+	}
+	if fee < 0 {
+		return nil, fmt.Errorf("invalid fee (%d)", fee)
+	}
+
+	utxos, err := w.Unspent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target, err := types.AddAmount(amount, fee)
+	if err != nil {
+		return nil, err
+	}
+	selected, total, err := SelectCoins(utxos, target)
+	if err != nil {
+		return nil, err
+	}
+	chainID, err := w.backend.ChainID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx := &proto.Transaction{
+		Version:     1,
+		ChainID:     chainID,
+		Replaceable: w.Replaceable,
+		Outputs: []*proto.TxOutput{
+			{
+				Amount:  amount,
+				Address: to.Bytes(),
+			},
+		},
+	}
+	if change := total - amount - fee; change > 0 {
+		tx.Outputs = append(tx.Outputs, &proto.TxOutput{
+			Amount:  change,
+			Address: w.keys[0].Public().Address().Bytes(),
+		})
+	}
+
+	keys := make([]*crypto.PrivateKey, len(selected))
+	amounts := make([]int64, len(selected))
+	for i, utxo := range selected {
+		pk, ok := w.keyFor(utxo.Address)
+		if !ok {
+			return nil, fmt.Errorf("no key for address %s", utxo.Address)
+		}
+		keys[i] = pk
+		amounts[i] = utxo.Amount
+
+		tx.Inputs = append(tx.Inputs, &proto.TxInput{
+			PrevTxHash:   utxo.TxHash,
+			PrevOutIndex: utxo.OutIndex,
+		})
+	}
+
+	if err := types.SignTransactionInputs(tx, keys, amounts); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// Send builds a transaction paying amount to the given address and submits
+// it to the node.
+func (w *Wallet) Send(ctx context.Context, to crypto.Address, amount, fee int64) (*proto.Transaction, error) {
+	tx, err := w.BuildTransaction(ctx, to, amount, fee)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.backend.SubmitTransaction(ctx, tx); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+type walletFile struct {
+	Seeds []string `json:"seeds"`
+}
+
+// Save writes the seeds of the wallet keys to path, readable by the owner only.
+func (w *Wallet) Save(path string) error {
+	file := walletFile{}
+	for _, pk := range w.keys {
+		file.Seeds = append(file.Seeds, hex.EncodeToString(pk.Bytes()[:crypto.SeedLen]))
+	}
+
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0600)
+}
+
+// Load reads a wallet written by Save.
+func Load(path string, backend Backend) (*Wallet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := walletFile{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*crypto.PrivateKey, len(file.Seeds))
+	for i, seed := range file.Seeds {
+		b, err := hex.DecodeString(seed)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != crypto.SeedLen {
+			return nil, fmt.Errorf("invalid seed length (%d)", len(b))
+		}
+		keys[i] = crypto.NewPrivateKeyFromSeed(b)
+	}
+
+	return New(backend, keys...), nil
+}
@@ -0,0 +1,145 @@
+package wallet
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	"github.com/wvalencia19/blocker/util"
+)
+
+type memoryBackend struct {
+	utxos     map[string][]*Unspent
+	submitted []*proto.Transaction
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		utxos: make(map[string][]*Unspent),
+	}
+}
+
+func (b *memoryBackend) fund(addr crypto.Address, amounts ...int64) {
+	for i, amount := range amounts {
+		b.utxos[addr.String()] = append(b.utxos[addr.String()], &Unspent{
+			TxHash:   util.RandomHash(),
+			OutIndex: uint32(i),
+			Amount:   amount,
+			Address:  addr,
+		})
+	}
+}
+
+func (b *memoryBackend) ListUnspent(ctx context.Context, addr crypto.Address) ([]*Unspent, error) {
+	return b.utxos[addr.String()], nil
+}
+
+func (b *memoryBackend) ChainID(ctx context.Context) (string, error) {
+	return "wallet-test", nil
+}
+
+func (b *memoryBackend) SubmitTransaction(ctx context.Context, tx *proto.Transaction) error {
+	b.submitted = append(b.submitted, tx)
+	return nil
+}
+
+func TestSelectCoins(t *testing.T) {
+	utxos := []*Unspent{{Amount: 5}, {Amount: 50}, {Amount: 20}}
+
+	selected, total, err := SelectCoins(utxos, 60)
+	require.Nil(t, err)
+	assert.Equal(t, int64(70), total)
+	assert.Equal(t, []*Unspent{utxos[1], utxos[2]}, selected)
+
+	selected, total, err = SelectCoins(utxos, 50)
+	require.Nil(t, err)
+	assert.Equal(t, int64(50), total)
+	assert.Len(t, selected, 1)
+
+	_, _, err = SelectCoins(utxos, 76)
+	assert.NotNil(t, err)
+}
+
+func TestWalletSend(t *testing.T) {
+	backend := newMemoryBackend()
+	w := New(backend, crypto.GeneratePrivatekey())
+	second := w.NewKey()
+	change := w.Addresses()[0]
+
+	backend.fund(change, 30)
+	backend.fund(second, 50, 10)
+
+	balance, err := w.Balance(context.Background())
+	require.Nil(t, err)
+	assert.Equal(t, int64(90), balance)
+
+	to := crypto.GeneratePrivatekey().Public().Address()
+	tx, err := w.Send(context.Background(), to, 70, 2)
+	require.Nil(t, err)
+	require.Len(t, backend.submitted, 1)
+	assert.Equal(t, tx, backend.submitted[0])
+	assert.Equal(t, "wallet-test", tx.ChainID)
+
+	require.Len(t, tx.Inputs, 2)
+	require.Len(t, tx.Outputs, 2)
+	assert.Equal(t, int64(70), tx.Outputs[0].Amount)
+	assert.Equal(t, to.Bytes(), tx.Outputs[0].Address)
+	assert.Equal(t, int64(8), tx.Outputs[1].Amount)
+	assert.Equal(t, change.Bytes(), tx.Outputs[1].Address)
+	assert.True(t, types.VerifyTransaction(tx, []int64{50, 30}))
+
+	_, err = w.Send(context.Background(), to, 89, 2)
+	assert.NotNil(t, err)
+	assert.Len(t, backend.submitted, 1)
+}
+
+func TestWalletNoChange(t *testing.T) {
+	backend := newMemoryBackend()
+	w := New(backend, crypto.GeneratePrivatekey())
+	backend.fund(w.Addresses()[0], 10)
+
+	tx, err := w.BuildTransaction(context.Background(), crypto.GeneratePrivatekey().Public().Address(), 9, 1)
+	require.Nil(t, err)
+	assert.Len(t, tx.Outputs, 1)
+	assert.True(t, types.VerifyTransaction(tx, []int64{10}))
+}
+
+func TestWalletAmountOverflow(t *testing.T) {
+	backend := newMemoryBackend()
+	w := New(backend, crypto.GeneratePrivatekey())
+	backend.fund(w.Addresses()[0], math.MaxInt64-1, 10)
+
+	_, err := w.Balance(context.Background())
+	assert.NotNil(t, err)
+
+	utxos, err := w.Unspent(context.Background())
+	require.Nil(t, err)
+	_, _, err = SelectCoins(utxos, math.MaxInt64)
+	assert.NotNil(t, err)
+
+	to := crypto.GeneratePrivatekey().Public().Address()
+	_, err = w.Send(context.Background(), to, math.MaxInt64-1, 5)
+	assert.NotNil(t, err)
+	_, err = w.Send(context.Background(), to, math.MaxInt64-4, 4)
+	assert.NotNil(t, err)
+	assert.Len(t, backend.submitted, 0)
+}
+
+func TestWalletSaveLoad(t *testing.T) {
+	w := New(nil)
+	w.NewKey()
+	w.NewKey()
+
+	path := filepath.Join(t.TempDir(), "wallet.json")
+	require.Nil(t, w.Save(path))
+
+	loaded, err := Load(path, nil)
+	require.Nil(t, err)
+	assert.Equal(t, w.Addresses(), loaded.Addresses())
+}
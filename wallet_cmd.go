@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+
+	"github.com/wvalencia19/blocker/crypto"
+	"github.com/wvalencia19/blocker/proto"
+	"github.com/wvalencia19/blocker/types"
+	"github.com/wvalencia19/blocker/wallet"
+	"google.golang.org/grpc"
+)
+
+func dialNode(addr string) (proto.NodeClient, error) {
+	c, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+
+	return proto.NewNodeClient(c), nil
+}
+
+func runWalletNew(args []string) error {
+	flags := flag.NewFlagSet("wallet new", flag.ExitOnError)
+	path := flags.String("wallet", "wallet.json", "wallet file, created when it does not exist")
+	flags.Parse(args)
+
+	w, err := wallet.Load(*path, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		w, err = wallet.New(nil), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	addr := w.NewKey()
+	if err := w.Save(*path); err != nil {
+		return err
+	}
+
+	fmt.Printf("address: %s\n", addr)
+	return nil
+}
+
+func loadWallet(path, nodeAddr string, pending bool) (*wallet.Wallet, error) {
+	c, err := dialNode(nodeAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	backend := wallet.NewNodeBackend(c)
+	backend.IncludePending = pending
+	return wallet.Load(path, backend)
+}
+
+func runWalletBalance(args []string) error {
+	flags := flag.NewFlagSet("wallet balance", flag.ExitOnError)
+	path := flags.String("wallet", "wallet.json", "wallet file")
+	nodeAddr := flags.String("node", ":3000", "address of the node to query")
+	pending := flags.Bool("pending", false, "count the outputs of transactions still in the mempool")
+	flags.Parse(args)
+
+	w, err := loadWallet(*path, *nodeAddr, *pending)
+	if err != nil {
+		return err
+	}
+
+	utxos, err := w.Unspent(context.Background())
+	if err != nil {
+		return err
+	}
+
+	balances := make(map[string]int64)
+	total := int64(0)
+	for _, utxo := range utxos {
+		addr := utxo.Address.String()
+		if balances[addr], err = types.AddAmount(balances[addr], utxo.Amount); err != nil {
+			return fmt.Errorf("balance of %s: %w", addr, err)
+		}
+		if total, err = types.AddAmount(total, utxo.Amount); err != nil {
+			return fmt.Errorf("total balance: %w", err)
+		}
+	}
+
+	for _, addr := range w.Addresses() {
+		fmt.Printf("%s  %d\n", addr, balances[addr.String()])
+	}
+	fmt.Printf("total: %d\n", total)
+	return nil
+}
+
+func runWalletSend(args []string) error {
+	flags := flag.NewFlagSet("wallet send", flag.ExitOnError)
+	path := flags.String("wallet", "wallet.json", "wallet file")
+	nodeAddr := flags.String("node", ":3000", "address of the node to submit to")
+	to := flags.String("to", "", "hex encoded address to pay")
+	amount := flags.Int64("amount", 0, "amount to send")
+	fee := flags.Int64("fee", 0, "fee paid to the block producer")
+	replaceable := flags.Bool("replaceable", false, "let a later send paying a higher fee replace this one while it is pending")
+	pending := flags.Bool("pending", false, "spend the outputs of transactions still in the mempool, like unconfirmed change")
+	flags.Parse(args)
+
+	b, err := hex.DecodeString(*to)
+	if err != nil {
+		return err
+	}
+	if len(b) != crypto.AddressLen {
+		return fmt.Errorf("invalid address length (%d)", len(b))
+	}
+
+	w, err := loadWallet(*path, *nodeAddr, *pending)
+	if err != nil {
+		return err
+	}
+
+	w.Replaceable = *replaceable
+	tx, err := w.Send(context.Background(), crypto.AddressFromBytes(b), *amount, *fee)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("tx: %s\n", hex.EncodeToString(types.HashTransaction(tx)))
+	return nil
+}